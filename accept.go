@@ -0,0 +1,102 @@
+package artemis
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrAcceptSaturated indicates that a connection was refused because the hub was already
+	// accepting as many connections as its accept limit allows.
+	ErrAcceptSaturated = errors.New("Too many connections are being accepted, try again later.")
+
+	// ErrAcceptRateExceeded indicates that a connection was refused because the hub was accepting
+	// connections faster than its accept rate allows.
+	ErrAcceptRateExceeded = errors.New("Connections are arriving too quickly, try again later.")
+)
+
+// acceptLimit bounds the number of connections a hub accepts at once.
+type acceptLimit struct {
+	slots   chan struct{}
+	queue   int32
+	waiting int32
+}
+
+// SetAcceptLimit allows at most concurrent connections to the hub to be accepted at once, with up
+// to queue more waiting for a turn.  Connections beyond that, or that wait longer than their
+// handshake timeout, are refused with http.StatusServiceUnavailable.  A concurrent limit of 0 or
+// less removes the limit.  It should be set before the hub starts accepting connections.
+func (h *Hub) SetAcceptLimit(concurrent, queue int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if concurrent <= 0 {
+		h.accepts = nil
+		return
+	}
+	h.accepts = &acceptLimit{slots: make(chan struct{}, concurrent), queue: int32(queue)}
+}
+
+// AcceptRate limits the hub to accepting perSecond new connections on average, with bursts of up
+// to burst, to smooth out storms of clients reconnecting at once.  Connections beyond the rate are
+// refused with http.StatusServiceUnavailable, so that clients back off and retry.  A perSecond of
+// 0 or less removes the limit.
+func (h *Hub) AcceptRate(perSecond int, burst int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if perSecond <= 0 {
+		h.acceptRate = nil
+		return
+	}
+	h.acceptRate = newTokenBucket(float64(perSecond), burst)
+}
+
+// admit checks the hub's accept rate.  If the connection is refused, the error response has
+// already been written when admit returns.
+func (h *Hub) admit(w http.ResponseWriter) error {
+	h.mu.RLock()
+	rate := h.acceptRate
+	h.mu.RUnlock()
+	if rate == nil || rate.allow() {
+		return nil
+	}
+	http.Error(w, ErrAcceptRateExceeded.Error(), http.StatusServiceUnavailable)
+	return ErrAcceptRateExceeded
+}
+
+// acquireAccept waits for a turn to accept a connection.  If the hub is saturated, the error
+// response has already been written when acquireAccept returns.  Otherwise, release must be called
+// once the connection has been accepted.
+func (h *Hub) acquireAccept(w http.ResponseWriter, timeout time.Duration) (release func(), err error) {
+	h.mu.RLock()
+	limit := h.accepts
+	h.mu.RUnlock()
+	if limit == nil {
+		return func() {}, nil
+	}
+	release = func() {
+		<-limit.slots
+	}
+
+	select {
+	case limit.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if atomic.AddInt32(&limit.waiting, 1) > limit.queue {
+		atomic.AddInt32(&limit.waiting, -1)
+		http.Error(w, ErrAcceptSaturated.Error(), http.StatusServiceUnavailable)
+		return nil, ErrAcceptSaturated
+	}
+	defer atomic.AddInt32(&limit.waiting, -1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case limit.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		http.Error(w, ErrAcceptSaturated.Error(), http.StatusServiceUnavailable)
+		return nil, ErrAcceptSaturated
+	}
+}
@@ -5,9 +5,16 @@
 package artemis
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,22 +26,47 @@ var (
 	// providing a custom parser
 	DefaultTextParser = ParseJSONMessage
 
+	// DeadlineExtractor finds the deadline that a client set on a message, which bounds the
+	// message's Context.  It can be overridden to recognize other fields or formats.
+	DeadlineExtractor = JSONDeadline
+
+	// SessionIDGenerator creates the IDs that are assigned to new clients.  It can be overridden
+	// to control the format or source of IDs, and must be safe to call concurrently.
+	SessionIDGenerator = randomID
+
+	// Marshaler encodes all outbound JSON.  It can be overridden to use a different encoder.
+	Marshaler = json.Marshal
+
+	// CloseGracePeriod is how long a connection that is being closed waits for the client to
+	// acknowledge the close frame before the underlying connection is dropped.
+	CloseGracePeriod = time.Second
+
 	// Timeout is the time allowed to write messages
 	Timeout     = 10 * time.Second
 	pongTimeout = Timeout * 6
 	pingPeriod  = (pongTimeout * 9) / 10
+	// pongJitter is the most that any connection's pong deadline may differ from pongTimeout, so
+	// that many clients timing out at once do not all disconnect at the same moment.
+	pongJitter = pongTimeout / 20
 
 	// Default WS configs - can be set at package level
 	// TODO, update for multiple protocols
 	ReadLimit                       int64 = 4096
 	HandshakeTimeout                      = 10 * time.Second
 	ReadBufferSize, WriteBufferSize int
+	// EnableCompression negotiates permessage-deflate with clients that support it, and compresses
+	// outgoing messages unless their kind is excluded with MessageAgent.SetKindCompression.
+	EnableCompression bool
 
 	// Errors sends errors encountered during send and receive and is meant to be consumed by a logger
 	// TODO provide default logger to stdout
+	// Errors and Warnings are never blocked on - if they are full, the error is dropped and counted.
+	// See LoggerBacklog and LoggerDropped.
 	Errors   = make(chan error, 256)
 	Warnings = make(chan error, 256)
 
+	droppedErrors, droppedWarnings uint64
+
 	// ErrHubMismatch occurs when trying to add a client to family with a different hub.
 	ErrHubMismatch = errors.New("Unable to add a client to a family in a different hub.")
 
@@ -58,15 +90,37 @@ var (
 	// in response to the same message
 	ErrDuplicateHandler = errors.New("An action already exists for that event or message name.")
 
-	ErrIllegalPingTimeout = errors.New("pingPeriod must be shorter than pongTimeout")
+	ErrIllegalPingTimeout = errors.New("pingPeriod must be shorter than pongTimeout less pongJitter")
+
+	// ErrMissedPong is reported when a connection is dropped because the client did not respond
+	// to a ping in time.
+	ErrMissedPong = errors.New("Client did not respond to ping before the pong timeout.")
 
 	ErrEventChannelHasClosed = errors.New("This client is no longer receiving events.")
 
+	// ErrSendBufferFull occurs when a message is pushed to an agent whose send buffer is full.
+	ErrSendBufferFull = errors.New("Unable to send message, the send buffer is full.")
+
+	// ErrSendTimeout occurs when no space frees up in an agent's send buffer before the timeout.
+	ErrSendTimeout = errors.New("Timed out waiting to send message.")
+
+	// ErrAlreadyAttached occurs when attaching a connection to an agent that already has one.
+	ErrAlreadyAttached = errors.New("The message agent already has a connection.")
+
+	// ErrNotAttached occurs when detaching the connection from an agent that doesn't have one.
+	ErrNotAttached = errors.New("The message agent has no connection.")
+
 	// TODO ID agent, provide IsLostConnError()
 	ErrMessageConnectionLost = errors.New("A message agent has lost its connection.")
 
 	ErrNoSubscribers = errors.New("Hub fired event but no one is listening.")
 
+	// ErrNilPrototype occurs when SubscribeDecoded is given no prototype to decode into.
+	ErrNilPrototype = errors.New("Can't decode messages without a prototype value.")
+
+	// ErrNoHub occurs when subscribing on an event agent that was not created by a hub.
+	ErrNoHub = errors.New("The event agent has no hub.")
+
 	errNotYetImplemented = errors.New("You are trying to use a feature that has not been implemented yet.")
 )
 
@@ -105,26 +159,59 @@ func init() {
 }
 
 func warn(e error) {
-	go sendWarning(e)
+	recordError(e, true)
+	sendWarning(e)
 }
 
 func throw(e error) {
-	go sendError(e)
+	recordError(e, false)
+	sendError(e)
 }
 
 func sendWarning(e error) {
 	// TODO write artemis prefix to all outgoing messages
-	Warnings <- e
+	select {
+	case Warnings <- e:
+	default:
+		atomic.AddUint64(&droppedWarnings, 1)
+	}
 }
 
 func sendError(e error) {
 	// TODO write artemis prefix to all outgoing messages
-	Errors <- e
+	select {
+	case Errors <- e:
+	default:
+		atomic.AddUint64(&droppedErrors, 1)
+	}
+}
+
+// LoggerBacklog returns the number of errors and warnings waiting to be consumed.
+func LoggerBacklog() (errors int, warnings int) {
+	return len(Errors), len(Warnings)
+}
+
+// LoggerDropped returns the number of errors and warnings that have been dropped because
+// Errors or Warnings was full.
+func LoggerDropped() (errors uint64, warnings uint64) {
+	return atomic.LoadUint64(&droppedErrors), atomic.LoadUint64(&droppedWarnings)
+}
+
+// ClearLoggerBacklog discards any errors and warnings waiting to be consumed.
+func ClearLoggerBacklog() {
+	for {
+		select {
+		case <-Errors:
+		case <-Warnings:
+		default:
+			return
+		}
+	}
 }
 
 // SetPingPeriod allows the application to specify the period between sending ping messages to clients
 func SetPingPeriod(n time.Duration) error {
-	if n >= pongTimeout {
+	if n >= pongTimeout-pongJitter {
 		return ErrIllegalPingTimeout
 	}
 	pingPeriod = n
@@ -133,13 +220,33 @@ func SetPingPeriod(n time.Duration) error {
 
 // SetPongTimeout allows the application to specify the period allowed to receive a pong message from clients
 func SetPongTimeout(n time.Duration) error {
-	if n <= pingPeriod {
+	if n-pongJitter <= pingPeriod {
 		return ErrIllegalPingTimeout
 	}
 	pongTimeout = n
 	return nil
 }
 
+// SetPongJitter allows the application to specify the maximum random amount by which each
+// connection's pong timeout differs from the configured pong timeout.
+func SetPongJitter(n time.Duration) error {
+	if n < 0 || pongTimeout-n <= pingPeriod {
+		return ErrIllegalPingTimeout
+	}
+	pongJitter = n
+	return nil
+}
+
+// randomID returns 16 bytes from crypto/rand, hex encoded.
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // ParseJSONMessage parses a ParsedMessage containing JSON data from bytes if possible.
 func ParseJSONMessage(m []byte) (*ParsedMessage, error) {
 	var (
@@ -155,10 +262,122 @@ func ParseJSONMessage(m []byte) (*ParsedMessage, error) {
 		return nil, ErrUnparseableMessage
 	}
 	output := NewParsedMessage(kind.(string), pm, m)
+	if id, ok := pm["id"].(string); ok {
+		output.ID = id
+	}
+	if key, ok := pm["idempotencyKey"].(string); ok {
+		output.IdempotencyKey = key
+	}
 
 	return output, err
 }
 
+// JSONDeadline extracts a deadline from a message parsed by ParseJSONMessage.  It recognizes a
+// "deadline" field holding an RFC 3339 time, or a "timeout" field holding a number of
+// milliseconds from when the message was received.
+func JSONDeadline(m *Message) (time.Time, bool) {
+	pm, ok := m.Data.(map[string]interface{})
+	if !ok {
+		return time.Time{}, false
+	}
+	if deadline, ok := pm["deadline"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, deadline); err == nil {
+			return t, true
+		}
+	}
+	if timeout, ok := pm["timeout"].(float64); ok {
+		return now().Add(time.Duration(timeout * float64(time.Millisecond))), true
+	}
+
+	return time.Time{}, false
+}
+
+// jsonMessage is the envelope for messages sent with MarshalJSONMessage.
+type jsonMessage struct {
+	Kind string      `json:"kind"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// MarshalJSONMessage encodes data as a message of the given kind using Marshaler.  The result
+// has the same shape that ParseJSONMessage expects: {"kind": kind, "data": data}
+func MarshalJSONMessage(kind string, data interface{}) ([]byte, error) {
+	return Marshaler(&jsonMessage{kind, data})
+}
+
+// SubscribeErrors collects the errors encountered by SubscribeMany, keyed by kind.
+type SubscribeErrors map[string]error
+
+func (se SubscribeErrors) Error() string {
+	kinds := make([]string, 0, len(se))
+	for kind := range se {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	msgs := make([]string, len(kinds))
+	for i, kind := range kinds {
+		msgs[i] = fmt.Sprintf("%s: %s", kind, se[kind])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (se SubscribeErrors) orNil() error {
+	if len(se) == 0 {
+		return nil
+	}
+	return se
+}
+
+// dispatchGuard defers changes to an agent's subscriptions while its handlers are being run, so
+// that a handler may unsubscribe itself or others without disturbing the delivery in progress.
+// Changes to a kind wait only for the deliveries of that kind, which may overlap.
+type dispatchGuard struct {
+	mu          sync.Mutex
+	dispatching map[string]int
+	pending     map[string][]func()
+}
+
+func (g *dispatchGuard) begin(kind string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.dispatching == nil {
+		g.dispatching = make(map[string]int)
+	}
+	g.dispatching[kind]++
+}
+
+// end applies the changes to kind that were deferred since begin, once no delivery of kind is in
+// progress.
+func (g *dispatchGuard) end(kind string) {
+	g.mu.Lock()
+	g.dispatching[kind]--
+	if g.dispatching[kind] > 0 {
+		g.mu.Unlock()
+		return
+	}
+	delete(g.dispatching, kind)
+	pending := g.pending[kind]
+	delete(g.pending, kind)
+	g.mu.Unlock()
+	for _, change := range pending {
+		change()
+	}
+}
+
+// deferChange holds change until end if handlers for kind are being run, and reports whether it
+// did.
+func (g *dispatchGuard) deferChange(kind string, change func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.dispatching[kind] == 0 {
+		return false
+	}
+	if g.pending == nil {
+		g.pending = make(map[string][]func())
+	}
+	g.pending[kind] = append(g.pending[kind], change)
+	return true
+}
+
 type SubscriptionSet map[chan *Event]struct{}
 
 func (ss SubscriptionSet) Add(c chan *Event) {
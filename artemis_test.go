@@ -1,13 +1,24 @@
 package artemis
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,12 +39,16 @@ var (
 
 // TODO how confusing is this signature?  the server is a client and the client is a conn
 func createTestClients(t *testing.T, id string, h *Hub) (client *websocket.Conn, server *Client) {
+	return createTestClientsWithDialer(t, id, h, websocket.DefaultDialer)
+}
+
+func createTestClientsWithDialer(t *testing.T, id string, h *Hub, d *websocket.Dialer) (client *websocket.Conn, server *Client) {
 	// TODO header?
 	u := url.URL{Scheme: "ws", Host: "localhost:" + testServerPort, Path: testPath}
 	if h != nil {
 		u.RawQuery = "hub_id=" + h.ID
 	}
-	client, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	client, _, err := d.Dial(u.String(), nil)
 	if err != nil {
 		t.Fatal("Failed to get ws client connection: ", err)
 	}
@@ -43,7 +58,7 @@ func createTestClients(t *testing.T, id string, h *Hub) (client *websocket.Conn,
 		t.Fatal("Failed to get ws server connection: ", err)
 	}
 	server = serverInterface.(*Client)
-	server.ID = id
+	server.SetID(id)
 
 	return
 }
@@ -81,7 +96,8 @@ func createTestServer() error {
 		// set up client and pass to client creation
 		c, err := hub.NewClient(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// the error response has already been written
+			return
 		}
 		connectedClients <- c
 	})
@@ -417,179 +433,4271 @@ func TestOffEvent(t *testing.T) {
 	}
 }
 
-// family specific
+func TestSubscribeBuffered(t *testing.T) {
+	h := DefaultHub()
+	agent := h.NewEventAgent()
+	started := make(chan interface{}, 5)
+	release := make(chan struct{})
+	fast := make(chan interface{}, 5)
 
-func TestFamilyClientHubMismatch(t *testing.T) {
-	t.Skip("Skipping ClientHubMismatch test.  Re-evaluating expected behavior")
-	// h1 := createTestHub(t, "h1")
-	// f1 := createTestFamily(t, "f1",  h1)
-	// f2 := createTestFamily(t, "f2", nil)
-	// f3 := createTestFamily(t, "f3", nil)
-	// _, c1 := createTestClients(t, "c1", nil)
+	agent.SubscribeBuffered("slow", 1, func(e *Event) {
+		started <- 1
+		<-release
+	})
+	agent.Subscribe("fast", func(e *Event) {
+		fast <- 1
+	})
 
-	// // err, _ := <-Errors, c1.Join(f1); err != ErrHubMismatch {
-	// // 	t.Error("Expected hub mismatch error, but none returned.")
-	// // }
-	// if err := c1.Join(f2, f3); err != nil {
-	// 	t.Error("Client should be able to join these families without issue.")
-	// }
+	h.Broadcast("slow", nil, nil)
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
+		t.Fatal("Buffered handler never started.")
+	}
+	// the first of these fills the queue, the second overflows
+	h.Broadcast("slow", nil, nil)
+	h.Broadcast("slow", nil, nil)
+	h.Broadcast("fast", nil, nil)
+	if _, err := waitForValueOrTimeout(fast, deadline); err != nil {
+		t.Fatal("Fast handler was held up by the slow buffered handler.")
+	}
+	// kinds are handled independently, so the slow events may not have reached the queue yet
+	timeout := time.After(deadline)
+	for agent.DroppedEvents("slow") < 1 {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the overflowing event to be dropped.")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if dropped := agent.DroppedEvents("slow"); dropped != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", dropped)
+	}
 
-	// c1.Leave(f2)
-	// c1.Leave(f3)
+	close(release)
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
+		t.Error("Queued event was not handled after release.")
+	}
+	cleanup()
+}
 
-	// err := c1.Join(f1, f2, f3)
-	// if err != ErrHubMismatch {
-	// 	t.Error("Expected hub mismatch when joining all 3 families, but none returned.")
-	// }
-	// if c1.BelongsTo(f1) || !c1.BelongsTo(f2) || !c1.BelongsTo(f3) {
-	// 	t.Error("Resulting family membership for c1 is not correct.")
-	// }
-	// cleanup()
+func TestBroadcastAck(t *testing.T) {
+	h := DefaultHub()
+	a1 := h.NewEventAgent()
+	a2 := h.NewEventAgent()
+	release := make(chan struct{})
+	finished := make(chan interface{}, 5)
+	eventName := "ackEvent"
+
+	a1.Subscribe(eventName, func(e *Event) {
+		finished <- 1
+	})
+	a2.SubscribeBuffered(eventName, 1, func(e *Event) {
+		<-release
+		finished <- 2
+	})
+
+	ack := h.BroadcastAck(eventName, nil, nil)
+	if _, err := waitForValueOrTimeout(finished, deadline); err != nil {
+		t.Fatal("Fast handler did not run.")
+	}
+	select {
+	case <-ack:
+		t.Fatal("Ack channel closed before the slow handler finished.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-ack:
+	case <-time.After(deadline):
+		t.Fatal("Ack channel was not closed after all handlers finished.")
+	}
+	if value, err := waitForValueOrTimeout(finished, deadline); err != nil || value.(int) != 2 {
+		t.Error("Slow handler should have finished before the ack.")
+	}
+	cleanup()
 }
 
-func TestFamilyJoinLeave(t *testing.T) {
+func TestSubscribeMany(t *testing.T) {
+	h := DefaultHub()
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 5)
+	respond := func(e *Event) {
+		ch <- e.Kind
+	}
+
+	err := agent.SubscribeMany(map[string]EventHandler{
+		"e1": respond,
+		"e2": respond,
+		"e3": respond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"e1", "e2", "e3"} {
+		h.Broadcast(kind, nil, nil)
+		if value, err := waitForValueOrTimeout(ch, deadline); err != nil || value != kind {
+			t.Errorf("%s not received correctly", kind)
+		}
+	}
+
+	err = agent.SubscribeMany(map[string]EventHandler{
+		"e1": respond,
+		"e4": respond,
+	})
+	errs, ok := err.(SubscribeErrors)
+	if !ok || len(errs) != 1 || errs["e1"] != ErrDuplicateHandler {
+		t.Error("Expected a single duplicate error for e1, got: ", err)
+	}
+	cleanup()
+}
+
+func TestFamilySubscribeMany(t *testing.T) {
 	_, c1 := createTestClients(t, "c1", nil)
 	f1 := createTestFamily(t, "f1", nil)
-	f2 := createTestFamily(t, "f2", nil)
-
-	c1.Join(f1, f2)
-	if !c1.BelongsTo(f1) || !c1.BelongsTo(f2) {
-		t.Fatal("c1 did not correctly join families.")
+	ch := make(chan interface{}, 5)
+	respond := func(e *Event) {
+		ch <- e.Kind
 	}
 
-	c1.Leave(f2)
-	if !c1.BelongsTo(f1) {
-		t.Error("c1 should still belong to f1")
+	c1.Join(f1)
+	err := f1.Events.SubscribeMany(map[string]EventHandler{
+		"e1": respond,
+		"e2": respond,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if c1.BelongsTo(f2) {
-		t.Error("c1 should no longer belong to f2")
+	for _, kind := range []string{"e1", "e2"} {
+		c1.Trigger(kind, nil)
+		if value, err := waitForValueOrTimeout(ch, deadline); err != nil || value != kind {
+			t.Errorf("%s not received correctly", kind)
+		}
 	}
 	cleanup()
 }
 
-// MESSAGES
-
-func TestOnMessage(t *testing.T) {
-	incoming, c1 := createTestClients(t, "c1", nil)
-	messageName := "testMessage"
-	ch := make(chan interface{})
+func TestSubscribeTransformed(t *testing.T) {
+	h := DefaultHub()
+	admin := h.NewEventAgent()
+	guest := h.NewEventAgent()
+	adminChan := make(chan interface{}, 1)
+	guestChan := make(chan interface{}, 1)
+	eventName := "profile"
+	redact := func(data interface{}) interface{} {
+		profile := data.(map[string]string)
+		return map[string]string{"name": profile["name"]}
+	}
 
-	c1.Messages.Subscribe(messageName, func(m *Message) {
-		ch <- 1
+	admin.Subscribe(eventName, func(e *Event) {
+		adminChan <- e.Data
 	})
-	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	guest.SubscribeTransformed(eventName, redact, func(e *Event) {
+		guestChan <- e.Data
+	})
+	h.Broadcast(eventName, &EventData{map[string]string{"name": "n", "email": "e"}}, nil)
+
+	adminData, err := waitForValueOrTimeout(adminChan, deadline)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+	guestData, err := waitForValueOrTimeout(guestChan, deadline)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if adminData.(map[string]string)["email"] != "e" {
+		t.Error("Untransformed subscriber should see the full data.")
+	}
+	if _, ok := guestData.(map[string]string)["email"]; ok {
+		t.Error("Transformed subscriber should see redacted data.")
+	}
 	cleanup()
 }
 
-func TestOffMessage(t *testing.T) {
-	incoming, c1 := createTestClients(t, "c1", nil)
-	messageName := "testMessage"
-	ch := make(chan interface{})
-	cb1 := func(m *Message) {
+func TestHandlerCircuitBreaker(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 5)
+	cooldown := 200 * time.Millisecond
+	eventName := "boom"
+
+	h.SetHandlerCircuitBreaker(2, time.Second, cooldown)
+	agent.Subscribe(eventName, func(e *Event) {
 		ch <- 1
+		panic("boom")
+	})
+	for i := 0; i < 2; i++ {
+		h.Broadcast(eventName, nil, nil)
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal("Handler should run until the breaker trips.")
+		}
+	}
+	h.Broadcast(eventName, nil, nil)
+	if _, err := waitForValueOrTimeout(ch, cooldown/2); err != errTimeoutWaitingForValue {
+		t.Fatal("Handler should not run while the breaker is open.")
 	}
 
-	c1.Messages.Subscribe(messageName, cb1)
-	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
-	if err != nil {
-		t.Fatal("Problem writing to incoming connection: ", err)
+	time.Sleep(cooldown)
+	h.Broadcast(eventName, nil, nil)
+	if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+		t.Error("Handler should run again after the cooldown.")
 	}
-	if _, err = waitForValueOrTimeout(ch, deadline); err != nil {
+	cleanup()
+}
+
+func TestDroppedSeqs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	started := make(chan interface{}, 1)
+	release := make(chan struct{})
+	eventName := "flood"
+
+	agent.Subscribe(eventName, func(e *Event) {
+		if e.HubSeq == 1 {
+			started <- 1
+			<-release
+		}
+	})
+	h.Broadcast(eventName, nil, nil)
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
 		t.Fatal(err)
 	}
+	// fill the agent's buffer, then overflow it twice
+	for i := 0; i < cap(agent.events)+2; i++ {
+		h.Broadcast(eventName, nil, nil)
+	}
+	// the agent sorts events by kind on its own goroutine, so the overflow is found asynchronously
+	timeout := time.After(deadline)
+	for len(agent.DroppedSeqs()) < 2 {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for events to be dropped.")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	close(release)
 
-	c1.Messages.Unsubscribe(messageName, cb1)
-	err = incoming.WriteMessage(websocket.TextMessage, testJSONObj)
-	if err != nil {
-		t.Fatal("Problem writing to incoming connection: ", err)
+	last := uint64(cap(agent.events) + 3)
+	dropped := agent.DroppedSeqs()
+	if fmt.Sprint(dropped) != fmt.Sprint([]uint64{last - 1, last}) {
+		t.Errorf("Expected dropped seqs %d and %d, got %v", last-1, last, dropped)
 	}
-	if _, err = waitForValueOrTimeout(ch, deadline); err != errTimeoutWaitingForValue {
-		t.Fatal("Listener should have been removed, but we got a value anyway.")
+	h.unsubscribe(eventName, agent.events)
+	if len(agent.DroppedSeqs()) != 0 {
+		t.Error("Dropped seqs should be forgotten once the agent no longer subscribes.")
 	}
+	ClearLoggerBacklog()
+	cleanup()
 }
 
-func TestFamilyOnMessage(t *testing.T) {
-	incoming, c1 := createTestClients(t, "c1", nil)
-	f1 := createTestFamily(t, "f1", nil)
-	messageName := "testMessage"
-	ch := make(chan interface{})
-	c1.Join(f1)
+func TestDelegateField(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	delegate := "assigned"
+	agent.Delegate = delegate
+	ch := make(chan interface{}, 1)
+	agent.Subscribe("delegated", func(e *Event) {
+		ch <- e.Recipient
+	})
 
-	f1.Messages.Subscribe(messageName, func(m *Message) {
-		log.Print("got a message")
-		log.Print(m)
-		ch <- m.Recipient
+	<-h.BroadcastAck("delegated", nil, nil)
+	if recipient := <-ch; recipient != delegate || agent.GetDelegate() != delegate {
+		t.Error("Expected the assigned Delegate field to receive events, got ", recipient)
+	}
+	cleanup()
+}
+
+// run with -race to verify
+func TestSetDelegateWhileDelivering(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 100)
+	eventName := "delegated"
+
+	agent.Subscribe(eventName, func(e *Event) {
+		ch <- e.Recipient
 	})
-	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
-	if err != nil {
-		t.Fatal(err)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			agent.SetDelegate(i)
+		}
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		h.Broadcast(eventName, nil, nil)
 	}
-	data, err := waitForValueOrTimeout(ch, deadline)
-	if err != nil {
-		t.Fatal(err)
+	<-done
+	for i := 0; i < 50; i++ {
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if data.(*Client).ID != "c1" {
-		t.Fatal("unexpected client id returned from message")
+
+	agent.SetDelegate("final")
+	h.Broadcast(eventName, nil, nil)
+	if recipient, err := waitForValueOrTimeout(ch, deadline); err != nil || recipient != "final" {
+		t.Error("Expected the latest delegate to receive subsequent events.")
 	}
 	cleanup()
 }
 
-func TestFamilyOnMessageRetro(t *testing.T) {
-	incoming, c1 := createTestClients(t, "c1", nil)
-	f1 := createTestFamily(t, "f1", nil)
-	messageName := "testMessage"
-	ch := make(chan interface{})
+func TestEventMiddleware(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 5)
+	eventName := "admin"
 
-	f1.Messages.Subscribe(messageName, func(m *Message) {
-		ch <- m.Recipient
+	h.UseEvent(func(e *Event, next func()) {
+		if e.Kind == eventName && e.Source == "guest" {
+			return
+		}
+		next()
+	})
+	h.UseEvent(func(e *Event, next func()) {
+		e.Data = "enriched"
+		next()
+	})
+	agent.Subscribe(eventName, func(e *Event) {
+		ch <- e
 	})
-	c1.Join(f1)
 
-	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	h.Broadcast(eventName, nil, "guest")
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Middleware should have vetoed the guest's broadcast.")
+	}
+	h.Broadcast(eventName, nil, "admin")
+	value, err := waitForValueOrTimeout(ch, deadline)
 	if err != nil {
+		t.Fatal("Admin's broadcast should have been delivered.")
+	}
+	if value.(*Event).Data != "enriched" {
+		t.Error("Expected the event to be enriched by the second middleware.")
+	}
+	cleanup()
+}
+
+func TestTriggerIncludeSelf(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	_, c2 := createTestClients(t, "c2", nil)
+	eventName := "selfEvent"
+	ch := make(chan interface{}, 5)
+	handler := func(e *Event) {
+		ch <- e.Recipient
+	}
+	c1.Events.Subscribe(eventName, handler)
+	c2.Events.Subscribe(eventName, handler)
+
+	if err := c1.TriggerWith(eventName, nil, TriggerOptions{IncludeSelf: false}); err != nil {
 		t.Fatal(err)
 	}
-	data, err := waitForValueOrTimeout(ch, deadline)
-	if err != nil {
+	if recipient, err := waitForValueOrTimeout(ch, deadline); err != nil || recipient != c2 {
+		t.Fatal("Expected only c2 to receive the event.")
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("The triggering client should not receive its own event.")
+	}
+
+	if err := c1.TriggerWith(eventName, nil, TriggerOptions{IncludeSelf: true}); err != nil {
 		t.Fatal(err)
 	}
-	if data.(*Client).ID != "c1" {
-		t.Fatal("unexpected client id returned from message")
+	received := make(map[interface{}]bool)
+	for i := 0; i < 2; i++ {
+		recipient, err := waitForValueOrTimeout(ch, deadline)
+		if err != nil {
+			t.Fatal("Expected both clients to receive the event.")
+		}
+		received[recipient] = true
+	}
+	if !received[c1] || !received[c2] {
+		t.Error("Expected both c1 and c2 to receive the event.")
 	}
 	cleanup()
 }
 
-func TestFamilyOffMessage(t *testing.T) {
-	incoming, c1 := createTestClients(t, "c1", nil)
-	f1 := createTestFamily(t, "f1", nil)
-	messageName := "testMessage"
-	ch := make(chan interface{})
-	cb1 := func(m *Message) {
-		ch <- 1
+func TestEventRedelivery(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SetRedelivery(2, 10*time.Millisecond)
+	_, c1 := createTestClients(t, "c1", h)
+	ch := make(chan interface{}, 5)
+	c1.Events.Subscribe("work", func(e *Event) {
+		ch <- e.Attempt
+		if e.Attempt < 3 {
+			e.Nack()
+		}
+	})
+	c1.Events.Subscribe("poison", func(e *Event) {
+		e.Nack()
+	})
+
+	h.Broadcast("work", nil, nil)
+	for i := 1; i <= 3; i++ {
+		attempt, err := waitForValueOrTimeout(ch, deadline)
+		if err != nil || attempt != i {
+			t.Fatal("Expected delivery attempt ", i, ", got ", attempt)
+		}
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Acked events should not be redelivered.")
 	}
-	c1.Join(f1)
 
-	f1.Messages.Subscribe(messageName, cb1)
-	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
-	if err != nil {
-		t.Fatal("Problem writing to incoming connection: ", err)
+	h.Broadcast("poison", nil, nil)
+	select {
+	case e := <-h.DeadLetters():
+		if e.Kind != "poison" || e.Attempt != 3 {
+			t.Error("Unexpected dead letter: ", e.Kind, e.Attempt)
+		}
+	case <-time.After(deadline):
+		t.Error("Expected the event to be dead lettered after the last retry.")
 	}
-	if _, err = waitForValueOrTimeout(ch, deadline); err != nil {
-		t.Fatal(err)
+	cleanup()
+}
+
+func TestSubscribeWithPolicy(t *testing.T) {
+	h := DefaultHub()
+	agent := h.NewEventAgent()
+	var running, maxSerial, maxConcurrent int32
+	done := make(chan interface{}, 10)
+	track := func(max *int32) EventHandler {
+		return func(e *Event) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(max)
+				if n <= m || atomic.CompareAndSwapInt32(max, m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			done <- 1
+		}
 	}
 
-	f1.Messages.Unsubscribe(messageName, cb1)
-	err = incoming.WriteMessage(websocket.TextMessage, testJSONObj)
-	if err != nil {
-		t.Fatal("Problem writing to incoming connection: ", err)
+	agent.SubscribeWithPolicy("serial", Serial, track(&maxSerial))
+	for i := 0; i < 3; i++ {
+		h.Broadcast("serial", nil, nil)
 	}
-	if _, err = waitForValueOrTimeout(ch, deadline); err != errTimeoutWaitingForValue {
-		t.Fatal("Listener should have been removed, but we got a value anyway.")
+	for i := 0; i < 3; i++ {
+		if _, err := waitForValueOrTimeout(done, deadline); err != nil {
+			t.Fatal("Serial handler did not run.")
+		}
+	}
+	if maxSerial != 1 {
+		t.Errorf("Serial handler runs overlapped, %d ran at once.", maxSerial)
 	}
+
+	agent.SubscribeWithPolicy("concurrent", Concurrent, track(&maxConcurrent))
+	for i := 0; i < 3; i++ {
+		h.Broadcast("concurrent", nil, nil)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := waitForValueOrTimeout(done, deadline); err != nil {
+			t.Fatal("Concurrent handler did not run.")
+		}
+	}
+	if maxConcurrent < 2 {
+		t.Error("Concurrent handler runs never overlapped.")
+	}
+	cleanup()
+}
+
+func TestCancelInFlight(t *testing.T) {
+	h := DefaultHub()
+	agent := h.NewEventAgent()
+	started := make(chan interface{}, 1)
+	cancelled := make(chan interface{}, 1)
+
+	agent.Subscribe("long", func(e *Event) {
+		started <- 1
+		select {
+		case <-e.Context().Done():
+			cancelled <- 1
+		case <-time.After(deadline):
+		}
+	})
+	h.Broadcast("long", nil, nil)
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
+		t.Fatal("Handler did not start.")
+	}
+	inFlight := h.InFlight()
+	if len(inFlight) != 1 || inFlight[0].Kind != "long" || inFlight[0].Recipient != agent {
+		t.Fatalf("Expected the long handler to be in flight, got %v", inFlight)
+	}
+
+	h.CancelInFlight()
+	if _, err := waitForValueOrTimeout(cancelled, deadline); err != nil {
+		t.Fatal("Handler context was not cancelled.")
+	}
+	time.Sleep(deadline / 10)
+	if inFlight := h.InFlight(); len(inFlight) != 0 {
+		t.Errorf("Expected no handlers in flight after cancelling, got %v", inFlight)
+	}
+	cleanup()
+}
+
+func TestHasSubscribers(t *testing.T) {
+	h := createTestHub(t, "h1")
+	if h.HasSubscribers("expensive") {
+		t.Error("Expected no subscribers before subscribing.")
+	}
+	h.NewEventAgent().Subscribe("expensive", func(e *Event) {})
+	if !h.HasSubscribers("expensive") {
+		t.Error("Expected subscribers after subscribing.")
+	}
+	cleanup()
+}
+
+func TestHubContext(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	started := make(chan interface{}, 1)
+	exited := make(chan interface{}, 1)
+	agent.Subscribe("work", func(e *Event) {
+		started <- 1
+		select {
+		case <-h.Context().Done():
+			exited <- 1
+		case <-time.After(deadline):
+		}
+	})
+
+	h.Broadcast("work", nil, nil)
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
+		t.Fatal("Handler did not start.")
+	}
+	if h.Context().Err() != nil {
+		t.Fatal("Hub context was cancelled before destruction.")
+	}
+	h.Destroy()
+	if _, err := waitForValueOrTimeout(exited, deadline); err != nil {
+		t.Error("Handler did not observe the hub context being cancelled.")
+	}
+	cleanup()
+}
+
+func TestSynchronousDelivery(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SynchronousDelivery = true
+	var (
+		mu      sync.Mutex
+		order   []string
+		nested  sync.Once
+		running int32
+	)
+	record := func(name string, slow bool) EventHandler {
+		return func(e *Event) {
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Error("Handlers ran concurrently under synchronous delivery.")
+			}
+			n := e.Data.(int)
+			mu.Lock()
+			order = append(order, fmt.Sprintf("%d:%s", n, name))
+			mu.Unlock()
+			if slow {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if n == 0 {
+				// broadcasting from a handler must not deadlock or interleave
+				nested.Do(func() { h.Broadcast("step", &EventData{100}, nil) })
+			}
+			atomic.AddInt32(&running, -1)
+		}
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		h.NewEventAgent().Subscribe("step", record(name, i == 1))
+	}
+
+	h.Broadcast("step", &EventData{0}, nil)
+	mu.Lock()
+	if len(order) != 6 {
+		t.Fatalf("Expected the broadcast and the nested broadcast to be handled before returning, got %v", order)
+	}
+	mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			h.Broadcast("step", &EventData{n}, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 36 {
+		t.Fatalf("Expected 36 handler runs, got %d: %v", len(order), order)
+	}
+	for i := 0; i < len(order); i += 3 {
+		event := strings.SplitN(order[i], ":", 2)[0]
+		for _, entry := range order[i : i+3] {
+			if !strings.HasPrefix(entry, event+":") {
+				t.Fatalf("Handlers of different events interleaved: %v", order)
+			}
+		}
+	}
+	if !strings.HasPrefix(order[3], "100:") {
+		t.Error("Nested broadcast was not delivered right after the event that made it: ", order)
+	}
+	cleanup()
+}
+
+func TestSubscribeWithoutHub(t *testing.T) {
+	EnableErrorHistory(16)
+	defer EnableErrorHistory(0)
+	// other tests' connections may still be reporting errors
+	reported := func() int {
+		n := 0
+		for _, e := range RecentErrors(16) {
+			if e.Err == ErrNoHub {
+				n++
+			}
+		}
+		return n
+	}
+	agent := &EventAgent{}
+	handler := func(e *Event) {}
+
+	agent.Subscribe("e1", handler)
+	if n := reported(); n != 1 {
+		t.Errorf("Expected Subscribe to report ErrNoHub once, reported %d times.", n)
+	}
+	err := agent.SubscribeMany(map[string]EventHandler{"e1": handler})
+	if errs, ok := err.(SubscribeErrors); !ok || errs["e1"] != ErrNoHub {
+		t.Error("Expected SubscribeMany to return ErrNoHub, got ", err)
+	}
+	agent.SubscribeBuffered("e1", 1, handler)
+	agent.Unsubscribe("e1", handler)
+	if n := reported(); n != 3 {
+		t.Errorf("Expected SubscribeBuffered and Unsubscribe to report ErrNoHub, reported %d in all.", n)
+	}
+}
+
+func TestSlowKindDoesNotBlockOtherKinds(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan interface{}, 1)
+	fast := make(chan interface{}, 10)
+
+	agent.Subscribe("slow", func(e *Event) {
+		started <- 1
+		<-release
+	})
+	agent.Subscribe("fast", func(e *Event) {
+		fast <- e.Kind
+	})
+
+	h.Broadcast("slow", nil, nil)
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
+		t.Fatal("Slow handler did not start.")
+	}
+	// more slow events queue up behind the blocked handler
+	h.Broadcast("slow", nil, nil)
+	for i := 0; i < 3; i++ {
+		h.Broadcast("fast", nil, nil)
+		if _, err := waitForValueOrTimeout(fast, deadline); err != nil {
+			t.Fatal("Fast event was held up by the blocked handler of another kind.")
+		}
+	}
+	cleanup()
+}
+
+// run with -race to verify
+func TestConcurrentSubscribe(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	var handled int32
+	handler := func(e *Event) {
+		atomic.AddInt32(&handled, 1)
+		if e.Kind == "k0" {
+			// subscribing from a handler must not deadlock
+			agent.Subscribe("nested", func(e *Event) {})
+		}
+	}
+	agent.Subscribe("k0", handler)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(2)
+		kind := fmt.Sprintf("k%d", i)
+		go func() {
+			defer wg.Done()
+			agent.Subscribe(kind, handler)
+			agent.SubscribeBuffered(kind, 4, func(e *Event) {})
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				h.Broadcast("k0", nil, nil)
+				h.Broadcast(kind, nil, nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-h.BroadcastAck("k8", nil, nil):
+	case <-time.After(deadline):
+		t.Fatal("Timed out waiting for handlers.")
+	}
+	if handlers, ok := agent.handlers("k8"); !ok || len(handlers) != 2 {
+		t.Errorf("Expected both handlers to be subscribed, got %d", len(handlers))
+	}
+	if atomic.LoadInt32(&handled) == 0 {
+		t.Error("No events were handled.")
+	}
+	ClearLoggerBacklog()
+	cleanup()
+}
+
+func TestSubscribeKeyed(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 4)
+	handlerFor := func(name string) EventHandler {
+		return func(e *Event) {
+			ch <- name
+		}
+	}
+
+	if err := agent.SubscribeKeyed("keyed", "a", handlerFor("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.SubscribeKeyed("keyed", "b", handlerFor("b")); err != nil {
+		t.Fatal("Identical closures with different keys should both subscribe: ", err)
+	}
+	if err := agent.SubscribeKeyed("keyed", "b", handlerFor("c")); err != ErrDuplicateHandler {
+		t.Error("Expected ErrDuplicateHandler for a key in use, got ", err)
+	}
+	<-h.BroadcastAck("keyed", nil, nil)
+	if len(ch) != 2 {
+		t.Fatalf("Expected both handlers to run, %d ran.", len(ch))
+	}
+	<-ch
+	<-ch
+
+	agent.UnsubscribeKeyed("keyed", "a")
+	<-h.BroadcastAck("keyed", nil, nil)
+	if len(ch) != 1 || <-ch != "b" {
+		t.Error("Expected only the handler with the remaining key to run.")
+	}
+	cleanup()
+}
+
+func TestUnsubscribeKeepsOtherHandlers(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	first := make(chan interface{}, 1)
+	second := make(chan interface{}, 1)
+	firstHandler := func(e *Event) { first <- 1 }
+	agent.Subscribe("shared", firstHandler)
+	agent.Subscribe("shared", func(e *Event) { second <- 1 })
+
+	agent.Unsubscribe("shared", firstHandler)
+	h.Broadcast("shared", nil, nil)
+	if _, err := waitForValueOrTimeout(second, deadline); err != nil {
+		t.Fatal("The remaining handler should still receive events: ", err)
+	}
+	if len(first) != 0 {
+		t.Error("The unsubscribed handler should not receive events.")
+	}
+	if !h.HasSubscribers("shared") {
+		t.Error("Expected the agent to stay subscribed to the hub.")
+	}
+	cleanup()
+}
+
+// family specific
+
+func TestFamilyClientHubMismatch(t *testing.T) {
+	t.Skip("Skipping ClientHubMismatch test.  Re-evaluating expected behavior")
+	// h1 := createTestHub(t, "h1")
+	// f1 := createTestFamily(t, "f1",  h1)
+	// f2 := createTestFamily(t, "f2", nil)
+	// f3 := createTestFamily(t, "f3", nil)
+	// _, c1 := createTestClients(t, "c1", nil)
+
+	// // err, _ := <-Errors, c1.Join(f1); err != ErrHubMismatch {
+	// // 	t.Error("Expected hub mismatch error, but none returned.")
+	// // }
+	// if err := c1.Join(f2, f3); err != nil {
+	// 	t.Error("Client should be able to join these families without issue.")
+	// }
+
+	// c1.Leave(f2)
+	// c1.Leave(f3)
+
+	// err := c1.Join(f1, f2, f3)
+	// if err != ErrHubMismatch {
+	// 	t.Error("Expected hub mismatch when joining all 3 families, but none returned.")
+	// }
+	// if c1.BelongsTo(f1) || !c1.BelongsTo(f2) || !c1.BelongsTo(f3) {
+	// 	t.Error("Resulting family membership for c1 is not correct.")
+	// }
+	// cleanup()
+}
+
+func TestFamilyJoinLeave(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	f2 := createTestFamily(t, "f2", nil)
+
+	c1.Join(f1, f2)
+	if !c1.BelongsTo(f1) || !c1.BelongsTo(f2) {
+		t.Fatal("c1 did not correctly join families.")
+	}
+
+	c1.Leave(f2)
+	if !c1.BelongsTo(f1) {
+		t.Error("c1 should still belong to f1")
+	}
+	if c1.BelongsTo(f2) {
+		t.Error("c1 should no longer belong to f2")
+	}
+	cleanup()
+}
+
+func TestFamilyJoinLeaveByID(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	f2 := createTestFamily(t, "f2", nil)
+
+	if f, ok := DefaultHub().Family("f1"); !ok || f != f1 || f.ID != "f1" {
+		t.Fatal("Family f1 should be registered on the hub by its ID.")
+	}
+	if _, ok := DefaultHub().Family("missing"); ok {
+		t.Error("Unexpected family found for an unknown ID.")
+	}
+
+	c1.JoinByID("f1", "f2")
+	if !c1.BelongsTo(f1) || !c1.BelongsTo(f2) {
+		t.Fatal("c1 did not correctly join families by ID.")
+	}
+	c1.LeaveByID("f2")
+	if !c1.BelongsTo(f1) || c1.BelongsTo(f2) {
+		t.Error("c1 should belong to f1 only after leaving f2 by ID.")
+	}
+	cleanup()
+}
+
+func TestDuplicateFamilyID(t *testing.T) {
+	h := createTestHub(t, "h1")
+	f1 := h.NewFamily("f1")
+	if f1.ID != "f1" || f1.Hub != h {
+		t.Error("Family was not created with the right ID and hub.")
+	}
+	if h.NewFamily("f1") != f1 {
+		t.Error("Expected the existing family for a duplicate ID.")
+	}
+	if NewFamily("f1") == f1 {
+		t.Error("Families with the same ID in different hubs should be distinct.")
+	}
+	if NewFamily("f1") != DefaultHub().NewFamily("f1") {
+		t.Error("Expected the existing default hub family for a duplicate ID.")
+	}
+	cleanup()
+}
+
+func TestTriggerFamilies(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	_, c2 := createTestClients(t, "c2", nil)
+	_, c3 := createTestClients(t, "c3", nil)
+	_, c4 := createTestClients(t, "c4", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	f2 := createTestFamily(t, "f2", nil)
+	f3 := createTestFamily(t, "f3", nil)
+	ch := make(chan interface{}, 10)
+	eventName := "roomEvent"
+
+	c1.Join(f1, f2)
+	c2.Join(f1, f2)
+	c3.Join(f2)
+	c4.Join(f3)
+	for _, c := range []*Client{c1, c2, c3, c4} {
+		c.Events.Subscribe(eventName, func(e *Event) {
+			ch <- e.Recipient.(*Client).ID
+		})
+	}
+	if len(c1.Families()) != 2 {
+		t.Fatal("Expected c1 to belong to 2 families.")
+	}
+
+	c1.TriggerFamilies(eventName, nil)
+	heard := make(map[string]int)
+	for {
+		id, err := waitForValueOrTimeout(ch, deadline/10)
+		if err != nil {
+			break
+		}
+		heard[id.(string)]++
+	}
+	for _, id := range []string{"c1", "c2", "c3"} {
+		if heard[id] != 1 {
+			t.Errorf("Expected %s to hear the event once, heard it %d times", id, heard[id])
+		}
+	}
+	if heard["c4"] != 0 {
+		t.Error("c4 is not in any of c1's families and should not hear the event.")
+	}
+	cleanup()
+}
+
+func TestTriggerRate(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	_, c2 := createTestClients(t, "c2", nil)
+	ch := make(chan interface{}, 10)
+	eventName := "spam"
+
+	c1.Events.Subscribe(eventName, func(e *Event) {
+		ch <- e.Source
+	})
+	c1.SetTriggerRate(0.1, 2)
+	for i := 0; i < 2; i++ {
+		if err := c1.TryTrigger(eventName, nil); err != nil {
+			t.Fatal("Triggers within the burst should be allowed: ", err)
+		}
+	}
+	if err := c1.TryTrigger(eventName, nil); err != ErrTriggerRateExceeded {
+		t.Error("Expected the trigger over budget to be rejected.")
+	}
+	if err := c2.TryTrigger(eventName, nil); err != nil {
+		t.Error("Other clients should not be limited: ", err)
+	}
+
+	heard := 0
+	for {
+		if _, err := waitForValueOrTimeout(ch, deadline/10); err != nil {
+			break
+		}
+		heard++
+	}
+	if heard != 3 {
+		t.Errorf("Expected 3 events to be delivered, got %d", heard)
+	}
+	cleanup()
+}
+
+func TestFamilyClear(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	_, c2 := createTestClients(t, "c2", nil)
+	_, c3 := createTestClients(t, "c3", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	ch := make(chan interface{}, 5)
+	left := make(chan interface{}, 5)
+	eventName := "familyEvent"
+
+	f1.OnLeave(func(d Delegate) {
+		left <- d
+	})
+	f1.Events.Subscribe(eventName, func(e *Event) {
+		ch <- e.Recipient
+	})
+	c1.Join(f1)
+	c2.Join(f1)
+	c3.Join(f1)
+	if f1.Size() != 3 {
+		t.Fatal("Expected 3 members, got ", f1.Size())
+	}
+
+	f1.Clear()
+	if f1.Size() != 0 {
+		t.Error("Expected an empty family after Clear, got ", f1.Size())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := waitForValueOrTimeout(left, deadline); err != nil {
+			t.Error("Expected OnLeave to fire for every member.")
+		}
+	}
+	c1.Trigger(eventName, nil)
+	f1.Trigger(eventName, nil, nil)
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Former members should not receive family events.")
+	}
+
+	// the family can be reused
+	c1.Join(f1)
+	c2.Trigger(eventName, nil)
+	if recipient, err := waitForValueOrTimeout(ch, deadline); err != nil || recipient != c1 {
+		t.Error("Rejoined member should receive family events.")
+	}
+	cleanup()
+}
+
+func TestFamilyLastValue(t *testing.T) {
+	h := createTestHub(t, "h1")
+	f1 := createTestFamily(t, "f1", h)
+	f1.EnableLastValue("state")
+	_, c1 := createTestClients(t, "c1", h)
+	incoming2, c2 := createTestClients(t, "c2", h)
+	c1.Join(f1)
+
+	f1.PushMessage([]byte(`{"kind":"state","data":1}`), websocket.TextMessage)
+	f1.PushMessage([]byte(`{"kind":"state","data":2}`), websocket.TextMessage)
+	f1.PushMessage([]byte(`{"kind":"chat","data":"hi"}`), websocket.TextMessage)
+
+	c2.Join(f1)
+	incoming2.SetReadDeadline(time.Now().Add(deadline))
+	_, m, err := incoming2.ReadMessage()
+	if err != nil {
+		t.Fatal("Late joiner did not receive the last value: ", err)
+	}
+	if string(m) != `{"kind":"state","data":2}` {
+		t.Error("Expected the last state message, got ", string(m))
+	}
+	incoming2.SetReadDeadline(time.Now().Add(deadline / 10))
+	if _, _, err := incoming2.ReadMessage(); err == nil {
+		t.Error("Only enabled kinds should be replayed.")
+	}
+	cleanup()
+}
+
+func TestFamilyMemberQueries(t *testing.T) {
+	f1 := createTestFamily(t, "f1", nil)
+	_, admin1 := createTestClients(t, "admin1", nil)
+	_, admin2 := createTestClients(t, "admin2", nil)
+	_, guest := createTestClients(t, "guest", nil)
+	admin1.Join(f1)
+	admin2.Join(f1)
+	guest.Join(f1)
+	isAdmin := func(d Delegate) bool {
+		return strings.HasPrefix(d.(*Client).ID, "admin")
+	}
+
+	if count := f1.CountWhere(isAdmin); count != 2 {
+		t.Error("Expected 2 admins, got ", count)
+	}
+	d, ok := f1.FindMember(func(d Delegate) bool {
+		return d.(*Client).ID == "guest"
+	})
+	if !ok || d != guest {
+		t.Error("Expected to find the guest.")
+	}
+	if _, ok := f1.FindMember(func(d Delegate) bool { return false }); ok {
+		t.Error("Expected no member to match.")
+	}
+
+	admin1.Leave(f1)
+	if count := f1.CountWhere(isAdmin); count != 1 {
+		t.Error("Expected 1 admin after one left, got ", count)
+	}
+	cleanup()
+}
+
+func TestFamilyDuplicatePolicy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	_, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	if err := f1.Add(c1); err != nil {
+		t.Fatal(err)
+	}
+
+	EnableErrorHistory(10)
+	defer EnableErrorHistory(0)
+	countWarnings := func() int {
+		count := 0
+		for _, te := range RecentErrors(10) {
+			if te.Warning && te.Err == ErrDuplicateDelegate {
+				count++
+			}
+		}
+		return count
+	}
+
+	if err := f1.Add(c1); err != nil {
+		t.Error("WarnIgnore should not return an error, got ", err)
+	}
+	if countWarnings() != 1 {
+		t.Error("WarnIgnore should warn about the duplicate.")
+	}
+
+	f1.DuplicatePolicy = DuplicateSilentIgnore
+	if err := f1.Add(c1); err != nil {
+		t.Error("SilentIgnore should not return an error, got ", err)
+	}
+	if countWarnings() != 1 {
+		t.Error("SilentIgnore should not warn about the duplicate.")
+	}
+
+	f1.DuplicatePolicy = DuplicateError
+	if err := f1.Add(c1); err != ErrDuplicateDelegate {
+		t.Error("Expected ErrDuplicateDelegate, got ", err)
+	}
+	if f1.Size() != 1 {
+		t.Error("Duplicates should never be added, size is ", f1.Size())
+	}
+	cleanup()
+}
+
+func TestFamilyLastValueLimits(t *testing.T) {
+	h := createTestHub(t, "h1")
+	f1 := createTestFamily(t, "f1", h)
+	messages := map[string][]byte{
+		"a": []byte(`{"kind":"a","data":1}`),
+		"b": []byte(`{"kind":"b","data":2}`),
+		"c": []byte(`{"kind":"c","data":3}`),
+	}
+	size := len(messages["a"])
+	for _, kind := range []string{"a", "b", "c"} {
+		f1.EnableLastValue(kind)
+	}
+	f1.SetLastValueLimits(2*size, 0)
+
+	for _, kind := range []string{"a", "b", "c"} {
+		f1.PushMessage(messages[kind], websocket.TextMessage)
+	}
+	if retained := h.RetainedBytes(); retained != int64(2*size) {
+		t.Error("Expected the oldest value to be evicted, retained bytes: ", retained)
+	}
+
+	incoming, c1 := createTestClients(t, "c1", h)
+	c1.Join(f1)
+	received := make(map[string]bool)
+	incoming.SetReadDeadline(time.Now().Add(deadline / 10))
+	for {
+		_, m, err := incoming.ReadMessage()
+		if err != nil {
+			break
+		}
+		received[string(m)] = true
+	}
+	if len(received) != 2 || !received[string(messages["b"])] || !received[string(messages["c"])] {
+		t.Error("Expected only the two newest values to be replayed, got ", received)
+	}
+
+	f1.SetLastValueLimits(0, 1)
+	if retained := h.RetainedBytes(); retained != int64(size) {
+		t.Error("Expected the count cap to evict down to one value, retained bytes: ", retained)
+	}
+	cleanup()
+}
+
+func TestFamilyPause(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	c1.Join(f1)
+	events := make(chan interface{}, 5)
+	f1.Events.Subscribe("turn", func(e *Event) {
+		events <- e.Data
+	})
+	messages := make(chan interface{}, 5)
+	go func() {
+		for {
+			_, m, err := incoming.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- string(m)
+		}
+	}()
+
+	f1.Pause(3)
+	for i := 0; i < 3; i++ {
+		f1.PushMessage([]byte(strconv.Itoa(i)), websocket.TextMessage)
+	}
+	// over the cap
+	f1.Trigger("turn", &EventData{"dropped"}, nil)
+	if _, err := waitForValueOrTimeout(messages, deadline/10); err != errTimeoutWaitingForValue {
+		t.Fatal("Messages should be withheld while the family is paused.")
+	}
+
+	f1.Resume()
+	for i := 0; i < 3; i++ {
+		m, err := waitForValueOrTimeout(messages, deadline)
+		if err != nil {
+			t.Fatal("Expected held messages to be flushed on resume.")
+		}
+		if m != strconv.Itoa(i) {
+			t.Error("Expected held messages in order, got ", m)
+		}
+	}
+	if _, err := waitForValueOrTimeout(events, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Deliveries beyond the cap should be dropped.")
+	}
+
+	f1.Trigger("turn", &EventData{"resumed"}, nil)
+	if data, err := waitForValueOrTimeout(events, deadline); err != nil || data != "resumed" {
+		t.Error("Expected deliveries after resume to be immediate.")
+	}
+	cleanup()
+}
+
+func TestFamilyResumeOrder(t *testing.T) {
+	f1 := createTestFamily(t, "f1", nil)
+	var mu sync.Mutex
+	var order []int
+	record := func(i int) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}
+	}
+	flushing := make(chan struct{})
+	proceed := make(chan struct{})
+	f1.Pause(5)
+	f1.sendOrHold(func() {
+		close(flushing)
+		<-proceed
+		record(0)()
+	})
+	f1.sendOrHold(record(1))
+
+	resumed := make(chan struct{})
+	go func() {
+		f1.Resume()
+		close(resumed)
+	}()
+	<-flushing
+	// sent while the held deliveries are being flushed
+	f1.sendOrHold(record(2))
+	close(proceed)
+	<-resumed
+	f1.sendOrHold(record(3))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(order, []int{0, 1, 2, 3}) {
+		t.Error("Expected deliveries made during Resume to wait for the held ones, got ", order)
+	}
+	cleanup()
+}
+
+func TestFamilyCapable(t *testing.T) {
+	h := createTestHub(t, "h1")
+	incoming1, c1 := createTestClients(t, "c1", h)
+	incoming2, c2 := createTestClients(t, "c2", h)
+	f1 := createTestFamily(t, "f1", h)
+	events := make(chan interface{}, 2)
+	f1.Events.Subscribe("v2", func(e *Event) {
+		events <- e.Recipient
+	})
+	c1.Join(f1)
+	c2.Join(f1)
+	c1.SetMetadata(CapabilitiesKey, []interface{}{"v1"})
+	c2.SetCapabilities("v1", "v2")
+
+	f1.TriggerCapable("v2", nil, "v2")
+	if value, err := waitForValueOrTimeout(events, deadline); err != nil || value != c2 {
+		t.Error("Capable member did not receive the event.")
+	}
+	if _, err := waitForValueOrTimeout(events, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Member without the capability received the event.")
+	}
+
+	f1.PushCapable([]byte("new"), websocket.TextMessage, "v2")
+	incoming2.SetReadDeadline(time.Now().Add(deadline))
+	if _, m, err := incoming2.ReadMessage(); err != nil || string(m) != "new" {
+		t.Error("Capable member did not receive the message.")
+	}
+	incoming1.SetReadDeadline(time.Now().Add(deadline / 10))
+	if _, _, err := incoming1.ReadMessage(); err == nil {
+		t.Error("Member without the capability received the message.")
+	}
+	if c1.HasCapability("v2") || !c1.HasCapability("v1") {
+		t.Error("HasCapability does not match the client's metadata.")
+	}
+	cleanup()
+}
+
+func TestFamilyAddAll(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	_, c2 := createTestClients(t, "c2", h)
+	f1 := createTestFamily(t, "f1", h)
+	ch := make(chan interface{}, 5)
+	f1.Events.Subscribe("move", func(e *Event) {
+		ch <- e.Recipient
+	})
+	joins := make(chan interface{}, 5)
+	f1.OnJoin(func(ds []Delegate) {
+		joins <- len(ds)
+	})
+
+	if err := f1.AddAll(c1, c2); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := waitForValueOrTimeout(joins, deadline); err != nil || value != 2 {
+		t.Error("Expected a single OnJoin callback with both members, got ", value)
+	}
+	f1.Trigger("move", nil, nil)
+	received := make(map[interface{}]bool)
+	for i := 0; i < 2; i++ {
+		value, err := waitForValueOrTimeout(ch, deadline)
+		if err != nil {
+			t.Fatal("Not every member received the family event.")
+		}
+		received[value] = true
+	}
+	if !received[c1] || !received[c2] {
+		t.Error("Expected both members to receive the family event.")
+	}
+	if f1.Size() != 2 {
+		t.Errorf("Expected 2 members, got %d", f1.Size())
+	}
+	cleanup()
+}
+
+func TestFamilySubscribeAny(t *testing.T) {
+	h := createTestHub(t, "h1")
+	f1 := createTestFamily(t, "f1", h)
+	_, c1 := createTestClients(t, "c1", h)
+	_, c2 := createTestClients(t, "c2", h)
+	_, c3 := createTestClients(t, "c3", h)
+	var runs int32
+	handler := func(e *Event) {
+		atomic.AddInt32(&runs, 1)
+	}
+
+	c1.Join(f1)
+	c2.Join(f1)
+	f1.Events.SubscribeAny("job", handler)
+	c3.Join(f1)
+
+	for i := 1; i <= 5; i++ {
+		select {
+		case <-h.BroadcastAck("job", nil, nil):
+		case <-time.After(deadline):
+			t.Fatal("Timed out waiting for the members to receive the event.")
+		}
+		if n := atomic.LoadInt32(&runs); n != int32(i) {
+			t.Fatalf("Expected exactly one member to handle each event, %d handled %d events.", n, i)
+		}
+	}
+
+	f1.Events.Unsubscribe("job", handler)
+	if h.HasSubscribers("job") {
+		t.Error("Members were still subscribed after the handler was unsubscribed.")
+	}
+	cleanup()
+}
+
+// MESSAGES
+
+func TestOnMessage(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	messageName := "testMessage"
+	ch := make(chan interface{})
+
+	c1.Messages.Subscribe(messageName, func(m *Message) {
+		ch <- 1
+	})
+	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+}
+
+func TestOffMessage(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	messageName := "testMessage"
+	ch := make(chan interface{})
+	cb1 := func(m *Message) {
+		ch <- 1
+	}
+
+	c1.Messages.Subscribe(messageName, cb1)
+	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal("Problem writing to incoming connection: ", err)
+	}
+	if _, err = waitForValueOrTimeout(ch, deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	c1.Messages.Unsubscribe(messageName, cb1)
+	err = incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal("Problem writing to incoming connection: ", err)
+	}
+	if _, err = waitForValueOrTimeout(ch, deadline); err != errTimeoutWaitingForValue {
+		t.Fatal("Listener should have been removed, but we got a value anyway.")
+	}
+}
+
+func TestFamilyOnMessage(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	messageName := "testMessage"
+	ch := make(chan interface{})
+	c1.Join(f1)
+
+	f1.Messages.Subscribe(messageName, func(m *Message) {
+		log.Print("got a message")
+		log.Print(m)
+		ch <- m.Recipient
+	})
+	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.(*Client).ID != "c1" {
+		t.Fatal("unexpected client id returned from message")
+	}
+	cleanup()
+}
+
+func TestFamilyOnMessageRetro(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	messageName := "testMessage"
+	ch := make(chan interface{})
+
+	f1.Messages.Subscribe(messageName, func(m *Message) {
+		ch <- m.Recipient
+	})
+	c1.Join(f1)
+
+	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.(*Client).ID != "c1" {
+		t.Fatal("unexpected client id returned from message")
+	}
+	cleanup()
+}
+
+func TestFamilyOffMessage(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	messageName := "testMessage"
+	ch := make(chan interface{})
+	cb1 := func(m *Message) {
+		ch <- 1
+	}
+	c1.Join(f1)
+
+	f1.Messages.Subscribe(messageName, cb1)
+	err := incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal("Problem writing to incoming connection: ", err)
+	}
+	if _, err = waitForValueOrTimeout(ch, deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	f1.Messages.Unsubscribe(messageName, cb1)
+	err = incoming.WriteMessage(websocket.TextMessage, testJSONObj)
+	if err != nil {
+		t.Fatal("Problem writing to incoming connection: ", err)
+	}
+	if _, err = waitForValueOrTimeout(ch, deadline); err != errTimeoutWaitingForValue {
+		t.Fatal("Listener should have been removed, but we got a value anyway.")
+	}
+}
+
+func TestSendError(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	messageName := "testMessage"
+	expected := `{"kind":"error","code":"rejected","message":"not allowed","relatedId":"m1","relatedKind":"testMessage"}`
+
+	c1.Messages.Subscribe(messageName, func(m *Message) {
+		if err := c1.SendError("rejected", "not allowed", m); err != nil {
+			t.Error(err)
+		}
+	})
+	err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"testMessage","id":"m1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	_, reply, err := incoming.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != expected {
+		t.Errorf("Unexpected error envelope.  Expected %s, got %s", expected, reply)
+	}
+	cleanup()
+}
+
+func TestSubscribeErr(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	expected := `{"kind":"error","code":"handlerError","message":"out of stock","relatedId":"m2","relatedKind":"order"}`
+
+	handler := func(m *Message) error {
+		if m.ID == "m1" {
+			return nil
+		}
+		return errors.New("out of stock")
+	}
+	c1.Messages.SubscribeErr("order", handler)
+	for _, m := range []string{`{"kind":"order","id":"m1"}`, `{"kind":"order","id":"m2"}`} {
+		if err := incoming.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	_, reply, err := incoming.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != expected {
+		t.Errorf("Expected an error reply only for the failed message.  Expected %s, got %s", expected, reply)
+	}
+	if err, _ := c1.LastError(); err == nil || err.Error() != "out of stock" {
+		t.Error("Expected the handler's error to be thrown, got ", err)
+	}
+
+	c1.Messages.UnsubscribeErr("order", handler)
+	if handlers, _ := c1.Messages.handlers("order"); len(handlers) != 0 {
+		t.Error("Expected UnsubscribeErr to remove the handler.")
+	}
+	cleanup()
+}
+
+// HUBS
+
+func TestHubs(t *testing.T) {
+	cleanup()
+	h1 := createTestHub(t, "h1")
+	h2 := createTestHub(t, "h2")
+	h3 := createTestHub(t, "h3")
+	h3.Release()
+
+	if all := Hubs(); !reflect.DeepEqual(all, []*Hub{h1, h2}) || HubCount() != 2 {
+		t.Errorf("Expected the registered hubs, got %v (%d)", all, HubCount())
+	}
+	d := DefaultHub()
+	if all := Hubs(); len(all) != 3 || all[0] != d || HubCount() != 3 {
+		t.Errorf("Expected the default hub to be included once created, got %v", all)
+	}
+	cleanup()
+}
+
+func TestHubRelease(t *testing.T) {
+	h1 := createTestHub(t, "h1")
+	h2 := createTestHub(t, "h2")
+
+	h1.Release()
+	if _, ok := hubs[h1.ID]; ok {
+		t.Error("Released hub is still registered.")
+	}
+	if h, err := NewHub(h1.ID); err != nil || h == h1 {
+		t.Error("Expected a new hub to be created with the released hub's ID.")
+	}
+
+	h2.Destroy()
+	if _, ok := hubs[h2.ID]; ok {
+		t.Error("Destroyed hub is still registered.")
+	}
+
+	d := DefaultHub()
+	if hubs[defaultHubID] != d {
+		t.Fatal("Default hub should be registered.")
+	}
+	d.Release()
+	if _, ok := hubs[defaultHubID]; ok {
+		t.Error("Released default hub is still registered.")
+	}
+	if DefaultHub() == d {
+		t.Error("Expected a fresh default hub after release.")
+	}
+	cleanup()
+}
+
+// LOGGING
+
+func TestLoggerDropsOnFlood(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	errorsBefore, warningsBefore := LoggerDropped()
+	goroutinesBefore := runtime.NumGoroutine()
+	flood := 10 * cap(Errors)
+
+	done := make(chan interface{})
+	go func() {
+		for i := 0; i < flood; i++ {
+			throw(errors.New("flood error"))
+			warn(errors.New("flood warning"))
+		}
+		done <- 1
+	}()
+	if _, err := waitForValueOrTimeout(done, deadline); err != nil {
+		t.Fatal("Flooding the logger blocked.")
+	}
+
+	errorsAfter, warningsAfter := LoggerDropped()
+	if errorsAfter == errorsBefore || warningsAfter == warningsBefore {
+		t.Error("Expected dropped counters to increase after flooding the logger.")
+	}
+	if goroutines := runtime.NumGoroutine(); goroutines > goroutinesBefore+5 {
+		t.Errorf("Flooding the logger leaked goroutines: %d before, %d after", goroutinesBefore, goroutines)
+	}
+	if e, w := LoggerBacklog(); e > cap(Errors) || w > cap(Warnings) {
+		t.Error("Logger backlog exceeds channel capacity.")
+	}
+	ClearLoggerBacklog()
+}
+
+type kindParser string
+
+func (kp kindParser) ParseText(m []byte) (*ParsedMessage, error) {
+	return NewParsedMessage(string(kp), string(m), m), nil
+}
+
+func (kp kindParser) ParseBinary(m []byte) (*ParsedMessage, error) {
+	return kp.ParseText(m)
+}
+
+func TestProtocolParser(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.RegisterProtocolParser("json.v1", kindParser("json"))
+	h.RegisterProtocolParser("plain.v1", kindParser("plain"))
+	dialer := &websocket.Dialer{Subprotocols: []string{"plain.v1"}}
+	incoming, c1 := createTestClientsWithDialer(t, "c1", h, dialer)
+	ch := make(chan interface{})
+
+	if incoming.Subprotocol() != "plain.v1" {
+		t.Fatal("Expected plain.v1 to be negotiated, got ", incoming.Subprotocol())
+	}
+	c1.Messages.Subscribe("plain", func(m *Message) {
+		ch <- m.Data
+	})
+	if err := incoming.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal("Message was not parsed by the mapped parser.")
+	}
+	if data.(string) != "hello" {
+		t.Error("Unexpected message data: ", data)
+	}
+
+	// no subprotocol falls back to the default parser
+	incoming, c2 := createTestClients(t, "c2", h)
+	c2.Messages.Subscribe("testMessage", func(m *Message) {
+		ch <- 1
+	})
+	if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+		t.Error("Message was not parsed by the default parser.")
+	}
+	cleanup()
+}
+
+func TestMessageSubscribeMany(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+	respond := func(m *Message) {
+		ch <- m.Kind
+	}
+
+	err := c1.Messages.SubscribeMany(map[string]MessageHandler{
+		"m1": respond,
+		"m2": respond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"m1", "m2"} {
+		if err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"`+kind+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := waitForValueOrTimeout(ch, deadline); err != nil || value != kind {
+			t.Errorf("%s not received correctly", kind)
+		}
+	}
+	cleanup()
+}
+
+func TestMessageSeq(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+
+	c1.Messages.Subscribe("testMessage", func(m *Message) {
+		ch <- m.Seq
+	})
+	for i := 1; i <= 3; i++ {
+		if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+			t.Fatal(err)
+		}
+		seq, err := waitForValueOrTimeout(ch, deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq.(uint64) != uint64(i) {
+			t.Errorf("Expected seq %d, got %d", i, seq)
+		}
+	}
+	if last := c1.Messages.LastSeq(); last != 3 {
+		t.Error("Expected LastSeq to be 3, got ", last)
+	}
+	cleanup()
+}
+
+func TestBeforeUpgrade(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.BeforeUpgrade(func(r *http.Request) (int, error) {
+		if r.Header.Get("X-Token") == "" {
+			return http.StatusForbidden, errors.New("missing token")
+		}
+		return 0, nil
+	})
+	u := url.URL{Scheme: "ws", Host: "localhost:" + testServerPort, Path: testPath, RawQuery: "hub_id=" + h.ID}
+
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err == nil {
+		t.Fatal("Expected the upgrade to be rejected.")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected a 403 response.")
+	}
+	if _, err := waitForValueOrTimeout(connectedClients, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("No client should have been created for a rejected upgrade.")
+	}
+
+	header := http.Header{}
+	header.Set("X-Token", "secret")
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		t.Fatal("Expected the upgrade to succeed with a token: ", err)
+	}
+	defer conn.Close()
+	if _, err := waitForValueOrTimeout(connectedClients, deadline); err != nil {
+		t.Error(err)
+	}
+	cleanup()
+}
+
+func TestUnconnectedMessageAgent(t *testing.T) {
+	agent := NewUnconnectedMessageAgent()
+	ch := make(chan interface{}, 1)
+
+	agent.Subscribe("testMessage", func(m *Message) {
+		ch <- m.Recipient
+	})
+	agent.acceptMessage(websocket.TextMessage, testJSONObj)
+	recipient, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal("Handler was not dispatched on an unconnected agent.")
+	}
+	if recipient.(*MessageAgent) != agent {
+		t.Error("Expected the agent to be the recipient.")
+	}
+	cleanup()
+}
+
+func TestPongJitter(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		_, c := createTestClients(t, "c", nil)
+		timeout := c.Messages.pongTimeout()
+		if timeout < pongTimeout-pongJitter || timeout > pongTimeout+pongJitter {
+			t.Errorf("Pong timeout %v outside of %v±%v", timeout, pongTimeout, pongJitter)
+		}
+		if timeout <= pingPeriod {
+			t.Error("Pong timeout must be longer than the ping period.")
+		}
+	}
+	if err := SetPongJitter(pongTimeout); err != ErrIllegalPingTimeout {
+		t.Error("Expected jitter that overlaps the ping period to be rejected.")
+	}
+	cleanup()
+}
+
+func TestKindDiscovery(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	f1 := createTestFamily(t, "f1", h)
+	noop := func(m *Message) {}
+
+	h.DeclareKind("declared", map[string]string{"name": "string"})
+	c1.Messages.Subscribe("agentKind", noop)
+	f1.Messages.Subscribe("familyKind", noop)
+
+	kinds := h.RegisteredKinds()
+	expected := []string{"agentKind", "declared", "familyKind"}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Errorf("Expected kinds %v, got %v", expected, kinds)
+	}
+
+	handler := h.Handler(nil, KindDiscovery("/kinds"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/kinds", nil))
+	body := strings.TrimSpace(w.Body.String())
+	expectedBody := `[{"kind":"agentKind"},{"kind":"declared","schema":{"name":"string"}},{"kind":"familyKind"}]`
+	if body != expectedBody {
+		t.Errorf("Unexpected discovery output: %s", body)
+	}
+	cleanup()
+}
+
+func TestKindInfoWhileSubscribing(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c1.Messages.Subscribe("kind"+strconv.Itoa(i), func(m *Message) {})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		h.KindInfo()
+	}
+	<-done
+	if len(h.KindInfo()) != 100 {
+		t.Error("Expected every subscribed kind to be described.")
+	}
+	cleanup()
+}
+
+func TestRecipientResolver(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 2)
+
+	c1.Messages.SetRecipientResolver(func(m *Message) interface{} {
+		return m.Data.(map[string]interface{})["as"]
+	})
+	c1.Messages.Subscribe("testMessage", func(m *Message) {
+		ch <- m.Recipient
+	})
+	for _, identity := range []string{"alice", "bob"} {
+		message := []byte(`{"kind":"testMessage","as":"` + identity + `"}`)
+		if err := incoming.WriteMessage(websocket.TextMessage, message); err != nil {
+			t.Fatal(err)
+		}
+		recipient, err := waitForValueOrTimeout(ch, deadline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recipient != identity {
+			t.Errorf("Expected recipient %s, got %v", identity, recipient)
+		}
+	}
+
+	c1.Messages.SetRecipientResolver(nil)
+	if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	if recipient, err := waitForValueOrTimeout(ch, deadline); err != nil || recipient != c1 {
+		t.Error("Expected the client to be the recipient without a resolver.")
+	}
+	cleanup()
+}
+
+// CLIENTS
+
+func TestSubscriptionSnapshot(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 2)
+	onEvent := func(e *Event) {
+		ch <- e.Recipient
+	}
+	onMessage := func(m *Message) {
+		ch <- m.Recipient
+	}
+
+	c1.Events.Subscribe("e1", onEvent)
+	c1.Messages.Subscribe("testMessage", onMessage)
+	snapshot := c1.SubscriptionSnapshot()
+	if len(snapshot.Events["e1"]) != 1 || len(snapshot.Messages["testMessage"]) != 1 {
+		t.Fatal("Snapshot did not capture the client's subscriptions.")
+	}
+
+	incoming, c2 := createTestClients(t, "c2", nil)
+	c2.RestoreSubscriptions(snapshot)
+	c2.Events.Hub.Broadcast("e1", nil, nil)
+	for i := 0; i < 2; i++ {
+		// both the original and the restored client hear the event
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal("Restored event subscription did not fire.")
+		}
+	}
+	if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	if recipient, err := waitForValueOrTimeout(ch, deadline); err != nil || recipient != c2 {
+		t.Fatal("Restored message subscription did not fire.")
+	}
+
+	// a deserialized snapshot has to have its tokens re-bound
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Snapshot
+	if err := json.Unmarshal(raw, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	loaded.BindEvent(loaded.Events["e1"][0], onEvent)
+	_, c3 := createTestClients(t, "c3", nil)
+	c3.RestoreSubscriptions(loaded)
+	if _, ok := c3.Events.subscriptions["e1"]; !ok {
+		t.Error("Bound event token was not restored.")
+	}
+	if _, ok := c3.Messages.subscriptions["testMessage"]; ok {
+		t.Error("Unbound message token should not have been restored.")
+	}
+	cleanup()
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.MaxInflightBytes = int64(len(testJSONObj)) + 10
+	incoming1, c1 := createTestClients(t, "c1", h)
+	incoming2, c2 := createTestClients(t, "c2", h)
+	started := make(chan interface{}, 1)
+	release := make(chan struct{})
+
+	c1.Messages.Subscribe("testMessage", func(m *Message) {
+		started <- 1
+		<-release
+	})
+	c2.Messages.Subscribe("testMessage", func(m *Message) {
+		t.Error("Message exceeding the in-flight budget should not be handled.")
+	})
+	if err := incoming1.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitForValueOrTimeout(started, deadline); err != nil {
+		t.Fatal(err)
+	}
+	if h.InflightBytes() != int64(len(testJSONObj)) {
+		t.Error("Unexpected in-flight bytes: ", h.InflightBytes())
+	}
+
+	if err := incoming2.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	incoming2.SetReadDeadline(time.Now().Add(deadline))
+	_, _, err := incoming2.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Error("Expected connection to be closed under memory pressure, got: ", err)
+	}
+
+	close(release)
+	cleanup()
+}
+
+func TestCustomMarshaler(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	defaultMarshaler := Marshaler
+	defer func() {
+		Marshaler = defaultMarshaler
+	}()
+	Marshaler = func(v interface{}) ([]byte, error) {
+		m, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(m, &fields); err != nil {
+			return nil, err
+		}
+		fields["server"] = "artemis"
+		return json.Marshal(fields)
+	}
+
+	if err := c1.Messages.SendEvent(&Event{Kind: "update", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	_, m, err := incoming.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"data":1,"kind":"update","server":"artemis"}`
+	if string(m) != expected {
+		t.Errorf("Expected %s, got %s", expected, m)
+	}
+	cleanup()
+}
+
+func TestPushMessageTimeout(t *testing.T) {
+	agent := NewUnconnectedMessageAgent()
+	// with nothing writing, fill the send buffer
+	for i := 0; i < cap(agent.sendText); i++ {
+		if err := agent.TryPushMessage(testJSONObj, websocket.TextMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := agent.TryPushMessage(testJSONObj, websocket.TextMessage); err != ErrSendBufferFull {
+		t.Fatal("Expected ErrSendBufferFull, got: ", err)
+	}
+	if err := agent.PushMessageTimeout(testJSONObj, websocket.TextMessage, 50*time.Millisecond); err != ErrSendTimeout {
+		t.Fatal("Expected ErrSendTimeout, got: ", err)
+	}
+
+	// a stalled writer frees up space within the timeout
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-agent.sendText
+	}()
+	if err := agent.PushMessageTimeout(testJSONObj, websocket.TextMessage, deadline); err != nil {
+		t.Error("Expected the push to succeed once space freed up, got: ", err)
+	}
+	cleanup()
+}
+
+func TestPushPriority(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent := DefaultHub().NewUnconnectedMessageAgent()
+		// queue before connecting, so that everything is waiting when the writer starts
+		for i := 0; i < 3; i++ {
+			agent.PushMessage([]byte("normal"), websocket.TextMessage)
+		}
+		agent.PushPriority([]byte("priority"), websocket.TextMessage)
+		agent.Connect(w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(deadline))
+	expected := []string{"priority", "normal", "normal", "normal"}
+	for _, e := range expected {
+		_, m, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m) != e {
+			t.Errorf("Expected %s, got %s", e, m)
+		}
+	}
+	cleanup()
+}
+
+func TestPresence(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.PresenceDebounce = 10 * time.Millisecond
+	changes := make(chan interface{}, 5)
+	h.OnPresenceChange(func(joined, left []*Client) {
+		changes <- [2][]*Client{joined, left}
+	})
+
+	incoming, c1 := createTestClients(t, "c1", h)
+	present := h.PresentClients()
+	if len(present) != 1 || present[0] != c1 {
+		t.Fatal("Expected c1 to be present.")
+	}
+	change, err := waitForValueOrTimeout(changes, deadline)
+	if err != nil {
+		t.Fatal("Presence change did not fire on connect.")
+	}
+	if joined := change.([2][]*Client)[0]; len(joined) != 1 || joined[0] != c1 {
+		t.Error("Expected c1 to have joined.")
+	}
+
+	incoming.Close()
+	change, err = waitForValueOrTimeout(changes, deadline)
+	if err != nil {
+		t.Fatal("Presence change did not fire on disconnect.")
+	}
+	if left := change.([2][]*Client)[1]; len(left) != 1 || left[0] != c1 {
+		t.Error("Expected c1 to have left.")
+	}
+	if len(h.PresentClients()) != 0 {
+		t.Error("Expected no clients to be present after disconnect.")
+	}
+	cleanup()
+}
+
+func TestRecentErrors(t *testing.T) {
+	EnableErrorHistory(3)
+	defer EnableErrorHistory(0)
+	if len(RecentErrors(3)) != 0 {
+		t.Fatal("Expected an empty history.")
+	}
+	for i := 1; i <= 5; i++ {
+		throw(fmt.Errorf("error %d", i))
+	}
+	warn(errors.New("warning"))
+
+	recent := RecentErrors(10)
+	if len(recent) != 3 {
+		t.Fatal("Expected the history to be capped at 3, got ", len(recent))
+	}
+	expected := []string{"warning", "error 5", "error 4"}
+	for i, te := range recent {
+		if te.Error() != expected[i] {
+			t.Errorf("Expected %s at position %d, got %s", expected[i], i, te.Error())
+		}
+		if te.Time.IsZero() {
+			t.Error("Expected errors to be timestamped.")
+		}
+	}
+	if !recent[0].Warning || recent[1].Warning {
+		t.Error("Expected warnings to be distinguished from errors.")
+	}
+	if len(RecentErrors(1)) != 1 {
+		t.Error("Expected RecentErrors to return at most n errors.")
+	}
+}
+
+func TestSubscribeDecoded(t *testing.T) {
+	type item struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+	handler := func(v interface{}, m *Message) {
+		ch <- v
+	}
+	c1.Messages.SubscribeDecoded("decoded", &item{}, handler)
+
+	err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"decoded","data":{"name":"thing","count":3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal("Decoded handler did not run.")
+	}
+	it, ok := value.(*item)
+	if !ok {
+		t.Fatalf("Expected *item, got %T", value)
+	}
+	if it.Name != "thing" || it.Count != 3 {
+		t.Error("Decoded value was not populated: ", it)
+	}
+
+	err = incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"decoded","data":{"count":"three"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Handler should be skipped when decoding fails.")
+	}
+	if err, _ := c1.LastError(); err == nil {
+		t.Error("Expected the decoding error to be recorded as the client's last error.")
+	}
+
+	c1.Messages.UnsubscribeDecoded("decoded", handler)
+	if handlers, _ := c1.Messages.handlers("decoded"); len(handlers) != 0 {
+		t.Error("Expected UnsubscribeDecoded to remove the handler.")
+	}
+	c1.Messages.SubscribeDecoded("nilPrototype", nil, handler)
+	if _, ok := c1.Messages.handlers("nilPrototype"); ok {
+		t.Error("A nil prototype should not be subscribed.")
+	}
+	cleanup()
+}
+
+func TestWriteFailureStopsReading(t *testing.T) {
+	_, c1 := createTestClients(t, "c1", nil)
+	agent := c1.Messages
+	// shutting down the write side leaves the read loop blocked until the agent coordinates
+	if err := agent.conn.(*websocket.Conn).UnderlyingConn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	agent.PushMessage([]byte("fails"), websocket.TextMessage)
+
+	stopped := make(chan interface{})
+	go func() {
+		agent.loops.Wait()
+		stopped <- 1
+	}()
+	if _, err := waitForValueOrTimeout(stopped, deadline); err != nil {
+		t.Fatal("Read loop did not exit after the write loop failed.")
+	}
+	// cleanup runs exactly once, even if triggered again
+	agent.cleanup()
+	agent.disconnect(websocket.CloseGoingAway)
+	cleanup()
+}
+
+func TestFamilyAsRecipient(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	f1 := createTestFamily(t, "f1", nil)
+	messageName := "testMessage"
+	ch := make(chan interface{}, 5)
+	c1.Join(f1)
+	f1.Messages.Subscribe(messageName, func(m *Message) {
+		ch <- m.Recipient
+	})
+
+	f1.Messages.AsRecipient(true)
+	if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient != f1 {
+		t.Errorf("Expected the family to be the recipient, got %T", recipient)
+	}
+
+	f1.Messages.AsRecipient(false)
+	if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	recipient, err = waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient != c1 {
+		t.Errorf("Expected the client to be the recipient, got %T", recipient)
+	}
+	cleanup()
+}
+
+func TestCoalesceBroadcasts(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	eventName := "cursor"
+	ch := make(chan interface{}, 20)
+	c1.Events.Subscribe(eventName, func(e *Event) {
+		ch <- e.Data
+	})
+	h.CoalesceBroadcasts(eventName, 50*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		h.Broadcast(eventName, &EventData{i}, nil)
+	}
+	value, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal("Coalesced event was never delivered.")
+	}
+	if value != 9 {
+		t.Error("Expected only the latest event of the burst, got ", value)
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Expected the rest of the burst to be coalesced away.")
+	}
+
+	// uncoalesced kinds are delivered as usual
+	h.CoalesceBroadcasts(eventName, 0)
+	h.Broadcast(eventName, &EventData{10}, nil)
+	h.Broadcast(eventName, &EventData{11}, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal("Expected every event once coalescing is off.")
+		}
+	}
+	cleanup()
+}
+
+func TestUnhandledEventStats(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	c1.Events.Subscribe("handled", func(e *Event) {})
+
+	h.Broadcast("dead1", nil, nil)
+	h.Broadcast("dead1", nil, nil)
+	h.Broadcast("dead2", nil, nil)
+	h.Broadcast("handled", nil, nil)
+
+	stats := h.UnhandledEventStats()
+	if stats["dead1"] != 2 || stats["dead2"] != 1 {
+		t.Error("Unexpected unhandled counts: ", stats)
+	}
+	if _, ok := stats["handled"]; ok {
+		t.Error("Handled kinds should not be counted.")
+	}
+
+	h.ResetUnhandledStats()
+	if len(h.UnhandledEventStats()) != 0 {
+		t.Error("Expected no stats after reset.")
+	}
+	cleanup()
+}
+
+func TestResetUnhandledStatsKeepsDeadLetters(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SetRedelivery(1, time.Millisecond)
+	agent := h.NewEventAgent()
+	agent.Subscribe("poison", func(e *Event) {
+		e.Nack()
+	})
+	deadLetters := h.DeadLetters()
+
+	h.ResetUnhandledStats()
+	h.Broadcast("poison", nil, nil)
+	select {
+	case e := <-deadLetters:
+		if e.Kind != "poison" {
+			t.Error("Unexpected dead letter: ", e.Kind)
+		}
+	case <-time.After(deadline):
+		t.Error("Expected a dead letters channel obtained before the reset to keep receiving.")
+	}
+	cleanup()
+}
+
+type jsonParser struct{}
+
+func (jsonParser) ParseText(m []byte) (*ParsedMessage, error) {
+	return ParseJSONMessage(m)
+}
+
+func (jsonParser) ParseBinary(m []byte) (*ParsedMessage, error) {
+	return ParseJSONMessage(m)
+}
+
+func TestParserChain(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	c1.Messages.SetParserChain(jsonParser{}, kindParser("plain"))
+	ch := make(chan interface{}, 5)
+	c1.Messages.Subscribe("testMessage", func(m *Message) {
+		ch <- m.Kind
+	})
+	c1.Messages.Subscribe("plain", func(m *Message) {
+		ch <- m.Data
+	})
+
+	if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	if kind, err := waitForValueOrTimeout(ch, deadline); err != nil || kind != "testMessage" {
+		t.Error("Expected JSON to be handled by the first parser.")
+	}
+	if err := incoming.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := waitForValueOrTimeout(ch, deadline); err != nil || data != "not json" {
+		t.Error("Expected plain text to fall through to the second parser.")
+	}
+
+	if _, err := parserChain([]MessageParser{jsonParser{}}).ParseText([]byte("not json")); err != ErrUnparseableMessage {
+		t.Error("Expected ErrUnparseableMessage when every parser fails, got ", err)
+	}
+	cleanup()
+}
+
+func TestAcceptLimit(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SetAcceptLimit(1, 1)
+	gate := make(chan struct{})
+	h.BeforeUpgrade(func(r *http.Request) (int, error) {
+		<-gate
+		return 0, nil
+	})
+	u := url.URL{Scheme: "ws", Host: "localhost:" + testServerPort, Path: testPath, RawQuery: "hub_id=" + h.ID}
+	goroutinesBefore := runtime.NumGoroutine()
+
+	type result struct {
+		conn   *websocket.Conn
+		status int
+	}
+	results := make(chan interface{}, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			conn, resp, _ := websocket.DefaultDialer.Dial(u.String(), nil)
+			r := result{conn: conn}
+			if resp != nil {
+				r.status = resp.StatusCode
+			}
+			results <- r
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		r, err := waitForValueOrTimeout(results, deadline)
+		if err != nil {
+			t.Fatal("Expected excess connections to be refused without waiting.")
+		}
+		if status := r.(result).status; status != http.StatusServiceUnavailable {
+			t.Fatal("Expected a 503 response, got ", status)
+		}
+	}
+
+	close(gate)
+	for i := 0; i < 2; i++ {
+		r, err := waitForValueOrTimeout(results, deadline)
+		if err != nil {
+			t.Fatal("Expected the accepted and queued connections to complete.")
+		}
+		conn := r.(result).conn
+		if conn == nil {
+			t.Fatal("Expected the accepted and queued connections to succeed.")
+		}
+		conn.Close()
+		if _, err := waitForValueOrTimeout(connectedClients, deadline); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(deadline / 10)
+	if goroutines := runtime.NumGoroutine(); goroutines > goroutinesBefore+5 {
+		t.Errorf("Refused connections leaked goroutines: %d before, %d after", goroutinesBefore, goroutines)
+	}
+	cleanup()
+}
+
+func TestConnStats(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+	c1.Messages.Subscribe("testMessage", func(m *Message) {
+		ch <- m
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := incoming.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := []byte("twelve bytes")
+	for i := 0; i < 3; i++ {
+		c1.Messages.PushMessage(out, websocket.TextMessage)
+		if _, _, err := incoming.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := c1.Messages.Stats()
+	if stats.MessagesRead != 2 || stats.BytesRead != uint64(2*len(testJSONObj)) {
+		t.Error("Unexpected read counts: ", stats)
+	}
+	if stats.MessagesWritten != 3 || stats.BytesWritten != uint64(3*len(out)) {
+		t.Error("Unexpected write counts: ", stats)
+	}
+	cleanup()
+}
+
+func TestTap(t *testing.T) {
+	h := createTestHub(t, "h1")
+	ch := make(chan interface{}, 5)
+	cancel := h.Tap(func(e *Event, subscriberCount int) {
+		ch <- fmt.Sprintf("%s:%d", e.Kind, subscriberCount)
+	})
+
+	h.Broadcast("nobodyListens", nil, nil)
+	if observed, err := waitForValueOrTimeout(ch, deadline); err != nil || observed != "nobodyListens:0" {
+		t.Error("Expected the tap to observe an event with no subscribers, got ", observed)
+	}
+
+	_, c1 := createTestClients(t, "c1", h)
+	c1.Events.Subscribe("somebodyListens", func(e *Event) {})
+	h.Broadcast("somebodyListens", nil, nil)
+	if observed, err := waitForValueOrTimeout(ch, deadline); err != nil || observed != "somebodyListens:1" {
+		t.Error("Expected the tap to observe the subscriber count, got ", observed)
+	}
+
+	cancel()
+	h.Broadcast("nobodyListens", nil, nil)
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Cancelled tap should not observe events.")
+	}
+	cleanup()
+}
+
+func TestMessageDeadline(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+	c1.Messages.Subscribe("slow", func(m *Message) {
+		select {
+		case <-m.Context().Done():
+			ch <- m.Context().Err()
+		case <-time.After(deadline):
+			ch <- nil
+		}
+	})
+	c1.Messages.Subscribe("unbounded", func(m *Message) {
+		_, hasDeadline := m.Context().Deadline()
+		ch <- hasDeadline
+	})
+
+	if err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"slow","timeout":50}`)); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := waitForValueOrTimeout(ch, deadline*2); err != nil || result != context.DeadlineExceeded {
+		t.Error("Expected the message context to expire at the client's deadline, got ", result)
+	}
+
+	if err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"unbounded"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if hasDeadline, err := waitForValueOrTimeout(ch, deadline); err != nil || hasDeadline != false {
+		t.Error("Expected no deadline without a deadline field.")
+	}
+	cleanup()
+}
+
+func TestMessageDeadlineUnconnected(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewUnconnectedMessageAgent()
+	ch := make(chan interface{}, 1)
+	agent.Subscribe("k", func(m *Message) {
+		_, hasDeadline := m.Context().Deadline()
+		ch <- hasDeadline
+	})
+
+	agent.acceptMessage(websocket.TextMessage, []byte(`{"kind":"k","timeout":50}`))
+	if hasDeadline, err := waitForValueOrTimeout(ch, deadline); err != nil || hasDeadline != true {
+		t.Error("Expected an unconnected agent to give the message its deadline.")
+	}
+	cleanup()
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+	defaultGrace := CloseGracePeriod
+	CloseGracePeriod = time.Second
+	defer func() {
+		CloseGracePeriod = defaultGrace
+	}()
+
+	incoming, c1 := createTestClients(t, "c1", nil)
+	c1.Messages.disconnect(websocket.CloseGoingAway)
+	select {
+	case <-c1.Messages.done:
+		t.Fatal("Connection was dropped before the client acknowledged the close frame.")
+	default:
+	}
+	// reading the close frame makes the client acknowledge it
+	if _, _, err := incoming.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatal("Expected the client to receive the close frame, got ", err)
+	}
+	if _, err := waitForValueOrTimeout(doneChannel(c1.Messages.done), CloseGracePeriod/2); err != nil {
+		t.Error("Expected the connection to close as soon as the client acknowledged.")
+	}
+
+	// a client that never acknowledges is dropped after the grace period.  The client side must
+	// stay referenced, or collecting it closes the connection early.
+	incoming2, c2 := createTestClients(t, "c2", nil)
+	defer incoming2.Close()
+	c2.Messages.disconnect(websocket.CloseGoingAway)
+	if _, err := waitForValueOrTimeout(doneChannel(c2.Messages.done), CloseGracePeriod/2); err != errTimeoutWaitingForValue {
+		t.Error("Connection was dropped before the grace period ended.")
+	}
+	if _, err := waitForValueOrTimeout(doneChannel(c2.Messages.done), CloseGracePeriod); err != nil {
+		t.Error("Connection was not dropped after the grace period.")
+	}
+	cleanup()
+}
+
+// doneChannel adapts a done channel for waitForValueOrTimeout.
+func doneChannel(done chan struct{}) chan interface{} {
+	ch := make(chan interface{}, 1)
+	go func() {
+		<-done
+		ch <- 1
+	}()
+	return ch
+}
+
+func TestLocate(t *testing.T) {
+	h := createTestHub(t, "h1")
+	incoming, c1 := createTestClients(t, "globalUser", h)
+
+	c, hub, ok := Locate("globalUser")
+	if !ok || c != c1 || hub != h {
+		t.Fatal("Expected to locate the client in its hub.")
+	}
+	if err := SendToClientGlobal("globalUser", []byte("found you"), websocket.TextMessage); err != nil {
+		t.Fatal(err)
+	}
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	if _, m, err := incoming.ReadMessage(); err != nil || string(m) != "found you" {
+		t.Error("Expected the client to receive the message, got ", string(m), err)
+	}
+	if err := SendToClientGlobal("nobody", []byte("lost"), websocket.TextMessage); err != ErrClientNotFound {
+		t.Error("Expected ErrClientNotFound, got ", err)
+	}
+
+	incoming.Close()
+	if _, err := waitForValueOrTimeout(doneChannel(c1.Messages.done), deadline); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := Locate("globalUser"); ok {
+		t.Error("Disconnected clients should not be located.")
+	}
+	cleanup()
+}
+
+func TestPongRTT(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	// reading lets the client answer pings
+	go incoming.ReadMessage()
+
+	start := time.Now()
+	if err := c1.Messages.ping(); err != nil {
+		t.Fatal(err)
+	}
+	for c1.Messages.RTT() == 0 && time.Since(start) < deadline {
+		time.Sleep(time.Millisecond)
+	}
+	rtt := c1.Messages.RTT()
+	if rtt <= 0 || rtt > time.Since(start) {
+		t.Fatal("Expected a sensible RTT, got ", rtt)
+	}
+
+	// pongs that don't echo the latest ping are ignored
+	c1.Messages.handlePong(strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano(), 10))
+	c1.Messages.handlePong("not a timestamp")
+	if c1.Messages.RTT() != rtt {
+		t.Error("Unmatched pongs should not change the RTT.")
+	}
+	cleanup()
+}
+
+func TestEventKindStats(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	_, c2 := createTestClients(t, "c2", h)
+	handler := func(e *Event) {}
+	c1.Events.Subscribe("shared", handler)
+	c2.Events.Subscribe("shared", handler)
+	c1.Events.Subscribe("c1only", handler)
+	// more handlers on the same agent don't add subscribers
+	c1.Events.Subscribe("c1only", func(e *Event) {})
+
+	stats := h.EventKindStats()
+	if len(stats) != 2 || stats["shared"] != 2 || stats["c1only"] != 1 {
+		t.Error("Unexpected kind stats: ", stats)
+	}
+	cleanup()
+}
+
+func TestSendStream(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	w, err := c1.Messages.SendStream(websocket.TextMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// queued messages wait for the stream to finish
+	c1.Messages.PushMessage([]byte("after"), websocket.TextMessage)
+	chunks := []string{"first ", "second ", "third"}
+	for _, chunk := range chunks {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	mtype, m, err := incoming.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtype != websocket.TextMessage || string(m) != strings.Join(chunks, "") {
+		t.Error("Expected the chunks to arrive as one text message, got ", string(m))
+	}
+	if _, m, err := incoming.ReadMessage(); err != nil || string(m) != "after" {
+		t.Error("Expected the queued message after the stream, got ", string(m), err)
+	}
+	cleanup()
+}
+
+func TestHandlerConcurrency(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SetHandlerConcurrency(1)
+	eventName := "slowWork"
+	ch := make(chan interface{}, 5)
+	var maxRunning int64
+	handler := func(e *Event) {
+		if running := h.RunningHandlers(); running > atomic.LoadInt64(&maxRunning) {
+			atomic.StoreInt64(&maxRunning, running)
+		}
+		time.Sleep(50 * time.Millisecond)
+		ch <- e.Recipient
+	}
+	for i := 0; i < 3; i++ {
+		_, c := createTestClients(t, fmt.Sprintf("c%d", i), h)
+		c.Events.Subscribe(eventName, handler)
+	}
+
+	h.Broadcast(eventName, nil, nil)
+	for i := 0; i < 3; i++ {
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal("Expected every queued handler to run eventually.")
+		}
+	}
+	if max := atomic.LoadInt64(&maxRunning); max != 1 {
+		t.Error("Expected handlers to run one at a time, saw ", max)
+	}
+	if running := h.RunningHandlers(); running != 0 {
+		t.Error("Expected no running handlers, got ", running)
+	}
+	cleanup()
+}
+
+func TestHandlerConcurrencySynchronousBroadcast(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SynchronousDelivery = true
+	h.SetHandlerConcurrency(1)
+	incoming, c1 := createTestClients(t, "c1", h)
+	ch := make(chan interface{}, 1)
+	c1.Events.Subscribe("inner", func(e *Event) {
+		ch <- 1
+	})
+	c1.Messages.Subscribe("outer", func(m *Message) {
+		// runs the inner handler inline, while this handler holds the only slot
+		h.Broadcast("inner", nil, nil)
+	})
+
+	if err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind":"outer"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+		t.Fatal("Expected a handler delivered inline not to wait for the slot its broadcaster holds.")
+	}
+	cleanup()
+}
+
+func TestHandlerConcurrencyCapsConcurrentGoroutines(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.SetHandlerConcurrency(2)
+	agent := h.NewEventAgent()
+	release := make(chan struct{})
+	var started int32
+	agent.SubscribeWithPolicy("burst", Concurrent, func(e *Event) {
+		atomic.AddInt32(&started, 1)
+		<-release
+	})
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		h.Broadcast("burst", nil, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("Expected 2 handlers to run at once, %d started.", n)
+	}
+	// the agent's listener and per-kind queue, and one goroutine per running handler
+	if extra := runtime.NumGoroutine() - before; extra > 4 {
+		t.Errorf("Expected waiting events not to start goroutines, %d were started.", extra)
+	}
+	close(release)
+	cleanup()
+}
+
+func TestDetachAttach(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+	c1.Messages.Subscribe("testMessage", func(m *Message) {
+		ch <- m.Recipient
+	})
+
+	old, err := c1.Messages.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c1.Messages.Detach(); err != ErrNotAttached {
+		t.Error("Expected ErrNotAttached, got ", err)
+	}
+	old.Close()
+	incoming.Close()
+
+	// upgrade a fresh connection outside of the hub
+	conns := make(chan interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer server.Close()
+	fresh, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	conn, err := waitForValueOrTimeout(conns, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c1.Messages.Attach(conn.(*websocket.Conn)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Messages.Attach(conn.(*websocket.Conn)); err != ErrAlreadyAttached {
+		t.Error("Expected ErrAlreadyAttached, got ", err)
+	}
+	if err := fresh.WriteMessage(websocket.TextMessage, testJSONObj); err != nil {
+		t.Fatal(err)
+	}
+	if recipient, err := waitForValueOrTimeout(ch, deadline); err != nil || recipient != c1 {
+		t.Error("Expected subscriptions to fire on the attached connection.")
+	}
+	c1.Messages.PushMessage([]byte("welcome back"), websocket.TextMessage)
+	fresh.SetReadDeadline(time.Now().Add(deadline))
+	if _, m, err := fresh.ReadMessage(); err != nil || string(m) != "welcome back" {
+		t.Error("Expected messages to be sent on the attached connection, got ", string(m), err)
+	}
+	cleanup()
+}
+
+// run with -race to verify
+func TestDetachWhileClosing(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		incoming, c1 := createTestClients(t, "c1", nil)
+		detached := make(chan Conn, 1)
+		go func() {
+			conn, _ := c1.Messages.Detach()
+			detached <- conn
+		}()
+		// close while Detach is waiting for the loops, unless it has already returned
+		for atomic.LoadInt32(&c1.Messages.detaching) == 0 && len(detached) == 0 {
+			runtime.Gosched()
+		}
+		c1.Messages.Close()
+		select {
+		case conn := <-detached:
+			if conn != nil {
+				conn.Close()
+			}
+		case <-time.After(deadline):
+			t.Fatal("Detach did not return while the agent was closing.")
+		}
+		incoming.Close()
+	}
+	cleanup()
+}
+
+func TestHandshakeTimeoutOption(t *testing.T) {
+	h := createTestHub(t, "h1")
+	fast := httptest.NewServer(h.Handler(nil, HandshakeTimeoutOption(time.Nanosecond)))
+	defer fast.Close()
+	normal := httptest.NewServer(h.Handler(nil))
+	defer normal.Close()
+
+	if conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(fast.URL, "http"), nil); err == nil {
+		conn.Close()
+		t.Error("Expected the handshake to time out on the route with a short timeout.")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(normal.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("Expected the default route to succeed: ", err)
+	}
+	conn.Close()
+	cleanup()
+}
+
+func TestCloneConfig(t *testing.T) {
+	template := createTestHub(t, "template")
+	template.RegisterProtocolParser("plain.v1", kindParser("plain"))
+	template.PresenceDebounce = 5 * time.Millisecond
+	template.MaxInflightBytes = 1024
+	template.SetHandlerConcurrency(3)
+	template.CoalesceBroadcasts("cursor", 20*time.Millisecond)
+	_, c1 := createTestClients(t, "c1", template)
+	c1.Events.Subscribe("templateEvent", func(e *Event) {})
+
+	clone, err := template.CloneConfig("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := clone.protocolParser("plain.v1"); !ok || p != kindParser("plain") {
+		t.Error("Expected the clone to have the template's parsers.")
+	}
+	if clone.PresenceDebounce != template.PresenceDebounce || clone.MaxInflightBytes != template.MaxInflightBytes {
+		t.Error("Expected the clone to have the template's settings.")
+	}
+	if cap(clone.handlerSlots) != 3 || clone.coalescer.windows["cursor"] != 20*time.Millisecond {
+		t.Error("Expected the clone to have the template's limits.")
+	}
+	if len(clone.EventKindStats()) != 0 || len(clone.PresentClients()) != 0 {
+		t.Error("Expected the clone to have no subscriptions or clients.")
+	}
+	if _, err := template.CloneConfig("tenant"); err != ErrDuplicateHubID {
+		t.Error("Expected ErrDuplicateHubID, got ", err)
+	}
+	cleanup()
+}
+
+func TestNewClientCancelledRequest(t *testing.T) {
+	h := createTestHub(t, "h1")
+	goroutinesBefore := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/"+testPath, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	if _, err := h.NewClient(w, r); err != context.Canceled {
+		t.Error("Expected context.Canceled, got ", err)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected a 503 response, got ", w.Code)
+	}
+	if goroutines := runtime.NumGoroutine(); goroutines > goroutinesBefore {
+		t.Errorf("Cancelled request started goroutines: %d before, %d after", goroutinesBefore, goroutines)
+	}
+	if len(h.PresentClients()) != 0 {
+		t.Error("No client should be registered for a cancelled request.")
+	}
+	cleanup()
+}
+
+func TestSessionIDGenerator(t *testing.T) {
+	defaultGenerator := SessionIDGenerator
+	defer func() {
+		SessionIDGenerator = defaultGenerator
+	}()
+	if a, b := SessionIDGenerator(), SessionIDGenerator(); len(a) != 32 || a == b {
+		t.Error("Expected distinct random IDs by default, got ", a, b)
+	}
+	var issued int32
+	SessionIDGenerator = func() string {
+		return fmt.Sprintf("tenant1-%d", atomic.AddInt32(&issued, 1))
+	}
+
+	h := createTestHub(t, "h1")
+	ids := make(chan interface{}, 2)
+	server := httptest.NewServer(h.Handler(func(c *Client) {
+		ids <- c.ID
+	}))
+	defer server.Close()
+	for i := 1; i <= 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		id, err := waitForValueOrTimeout(ids, deadline)
+		if err != nil || id != fmt.Sprintf("tenant1-%d", i) {
+			t.Error("Expected the generated ID, got ", id)
+		}
+	}
+	cleanup()
+}
+
+func TestDrainAndDestroy(t *testing.T) {
+	h := createTestHub(t, "h1")
+	incoming1, _ := createTestClients(t, "c1", h)
+	incoming2, _ := createTestClients(t, "c2", h)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	if err := h.DrainAndDestroy(ctx, []byte("going down"), websocket.TextMessage); err != nil {
+		t.Fatal(err)
+	}
+	for _, incoming := range []*websocket.Conn{incoming1, incoming2} {
+		incoming.SetReadDeadline(time.Now().Add(deadline))
+		if _, m, err := incoming.ReadMessage(); err != nil || string(m) != "going down" {
+			t.Error("Expected the notice before disconnecting, got ", string(m), err)
+		}
+		if _, _, err := incoming.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Error("Expected to be disconnected with CloseGoingAway, got ", err)
+		}
+	}
+	server := httptest.NewServer(h.Handler(nil))
+	defer server.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("A drained hub should refuse connections with 503.")
+	}
+	cleanup()
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestSetKindCompression(t *testing.T) {
+	EnableCompression = true
+	defer func() {
+		EnableCompression = false
+	}()
+	var counter *countingConn
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			counter = &countingConn{Conn: conn}
+			return counter, nil
+		},
+	}
+	incoming, c1 := createTestClientsWithDialer(t, "c1", nil, dialer)
+	c1.Messages.SetKindCompression("image", false)
+	payload := strings.Repeat("a", 2000)
+
+	sizeOf := func(kind string) int64 {
+		m, err := MarshalJSONMessage(kind, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := atomic.LoadInt64(&counter.read)
+		c1.Messages.PushMessage(m, websocket.TextMessage)
+		incoming.SetReadDeadline(time.Now().Add(deadline))
+		if _, _, err := incoming.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		return atomic.LoadInt64(&counter.read) - before
+	}
+	if size := sizeOf("image"); size < int64(len(payload)) {
+		t.Errorf("Expected image to be sent uncompressed, read %d bytes.", size)
+	}
+	if size := sizeOf("text"); size >= int64(len(payload)) {
+		t.Errorf("Expected text to be compressed, read %d bytes.", size)
+	}
+	cleanup()
+}
+
+func TestAuthExtractor(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.AuthExtractor = func(r *http.Request) (map[string]interface{}, error) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil, errors.New("missing bearer token")
+		}
+		return map[string]interface{}{"token": strings.TrimPrefix(auth, "Bearer ")}, nil
+	}
+	clients := make(chan interface{}, 1)
+	server := httptest.NewServer(h.Handler(func(c *Client) {
+		clients <- c
+	}))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		t.Fatal("Failed to connect with a bearer token: ", err)
+	}
+	defer conn.Close()
+	value, err := waitForValueOrTimeout(clients, deadline)
+	if err != nil {
+		t.Fatal("Client was not created.")
+	}
+	if token, ok := value.(*Client).Metadata("token"); !ok || token != "secret" {
+		t.Errorf("Expected token 'secret' in metadata, got %v", token)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected a connection without a token to be rejected with 401.")
+	}
+	cleanup()
+}
+
+func TestConnectedEvent(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 1)
+	agent.Subscribe(DefaultConnectedKind, func(e *Event) {
+		ch <- e.Data
+	})
+
+	_, c1 := createTestClients(t, "c1", h)
+	value, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal("Connected event was not broadcast.")
+	}
+	if value != c1 {
+		t.Error("Expected the connected client as the event data.")
+	}
+
+	h.ConnectedKind = ""
+	createTestClients(t, "c2", h)
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Connected event was broadcast after it was disabled.")
+	}
+	cleanup()
+}
+
+func TestBroadcastSampled(t *testing.T) {
+	h := createTestHub(t, "h1")
+	const subscribers = 200
+	var received int64
+	agents := make([]*EventAgent, subscribers)
+	var got [subscribers]int32
+	for i := range agents {
+		i := i
+		agents[i] = h.NewEventAgent()
+		agents[i].Subscribe("diagnostic", func(e *Event) {
+			atomic.AddInt32(&got[i], 1)
+			atomic.AddInt64(&received, 1)
+		})
+	}
+
+	sample := func() []int32 {
+		for i := range got {
+			atomic.StoreInt32(&got[i], 0)
+		}
+		atomic.StoreInt64(&received, 0)
+		h.SetSamplingSeed(42)
+		h.BroadcastSampled("diagnostic", nil, nil, 0.5)
+		time.Sleep(deadline / 10)
+		snapshot := make([]int32, subscribers)
+		for i := range got {
+			snapshot[i] = atomic.LoadInt32(&got[i])
+		}
+		return snapshot
+	}
+
+	first := sample()
+	if n := atomic.LoadInt64(&received); n < subscribers*3/10 || n > subscribers*7/10 {
+		t.Errorf("Expected about half of %d subscribers to receive, %d did.", subscribers, n)
+	}
+	second := sample()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatal("Seeded samples chose different subscribers.")
+		}
+	}
+	cleanup()
+}
+
+func TestRebroadcastMessageAsEvent(t *testing.T) {
+	h := createTestHub(t, "h1")
+	incoming, c1 := createTestClients(t, "c1", h)
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 1)
+	agent.Subscribe("chat", func(e *Event) {
+		ch <- e
+	})
+	c1.Messages.Subscribe("chat", func(m *Message) {
+		if e := m.ToEvent(); e.Kind != m.Kind || e.Recipient != c1 {
+			t.Error("ToEvent did not map the message's kind and recipient.")
+		}
+		h.RebroadcastMessageAsEvent(m)
+	})
+
+	if err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind": "chat", "text": "hi"}`)); err != nil {
+		t.Fatal(err)
+	}
+	value, err := waitForValueOrTimeout(ch, deadline)
+	if err != nil {
+		t.Fatal("Message was not rebroadcast as an event.")
+	}
+	e := value.(*Event)
+	if data, ok := e.Data.(map[string]interface{}); !ok || data["text"] != "hi" || e.Source != c1 {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+	cleanup()
+}
+
+func TestMaxFamiliesPerClient(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.MaxFamiliesPerClient = 2
+	_, c1 := createTestClients(t, "c1", h)
+	f1 := createTestFamily(t, "f1", h)
+	f2 := createTestFamily(t, "f2", h)
+	f3 := createTestFamily(t, "f3", h)
+
+	if err := c1.Join(f1, f2); err != nil {
+		t.Fatal("Joining up to the limit failed: ", err)
+	}
+	if err := c1.Join(f3); err != ErrTooManyFamilies {
+		t.Error("Expected ErrTooManyFamilies, got ", err)
+	}
+	if c1.BelongsTo(f3) {
+		t.Error("Client joined a family beyond the limit.")
+	}
+
+	c1.Leave(f1)
+	if err := c1.Join(f3); err != nil || !c1.BelongsTo(f3) {
+		t.Error("Joining after leaving a family failed: ", err)
+	}
+	cleanup()
+}
+
+func TestMaxFamiliesPerClientConcurrentJoins(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.MaxFamiliesPerClient = 2
+	_, c1 := createTestClients(t, "c1", h)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		f := createTestFamily(t, "f"+strconv.Itoa(i), h)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c1.Join(f)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(c1.Families()); n != 2 {
+		t.Errorf("Expected concurrent joins to stop at the limit, the client is in %d families.", n)
+	}
+	cleanup()
+}
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+func (c *fakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func TestFakeClockPing(t *testing.T) {
+	fake := &fakeClock{now: time.Unix(1000, 0)}
+	SetClockForTesting(fake)
+	defer SetClockForTesting(nil)
+	incoming, c1 := createTestClients(t, "c1", nil)
+	pings := make(chan interface{}, 1)
+	incoming.SetPingHandler(func(data string) error {
+		// the pong arrives 7ms after the ping, by the fake clock
+		fake.Advance(7 * time.Millisecond)
+		pings <- data
+		return incoming.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(Timeout))
+	})
+	go func() {
+		for {
+			if _, _, err := incoming.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for fake.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := waitForValueOrTimeout(pings, deadline/10); err != errTimeoutWaitingForValue {
+		t.Fatal("Pinged before the fake clock advanced.")
+	}
+	fake.Advance(pingPeriod)
+	if _, err := waitForValueOrTimeout(pings, deadline); err != nil {
+		t.Fatal("No ping after advancing the fake clock by the ping period.")
+	}
+	for start := time.Now(); c1.Messages.RTT() == 0 && time.Since(start) < deadline; {
+		time.Sleep(time.Millisecond)
+	}
+	if rtt := c1.Messages.RTT(); rtt != 7*time.Millisecond {
+		t.Errorf("Expected an RTT of 7ms by the fake clock, got %v", rtt)
+	}
+	cleanup()
+}
+
+func TestUnsubscribeDuringDelivery(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	ch := make(chan interface{}, 5)
+	var once MessageHandler
+	once = func(m *Message) {
+		c1.Messages.Unsubscribe("tick", once)
+		ch <- "once"
+	}
+	always := func(m *Message) {
+		ch <- "always"
+	}
+	c1.Messages.Subscribe("tick", once)
+	c1.Messages.Subscribe("tick", always)
+
+	received := func() map[interface{}]int {
+		if err := incoming.WriteMessage(websocket.TextMessage, []byte(`{"kind": "tick"}`)); err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[interface{}]int)
+		for {
+			value, err := waitForValueOrTimeout(ch, deadline/10)
+			if err != nil {
+				return counts
+			}
+			counts[value]++
+		}
+	}
+	if counts := received(); counts["once"] != 1 || counts["always"] != 1 {
+		t.Errorf("Expected both handlers to run on the first message, got %v", counts)
+	}
+	if counts := received(); counts["once"] != 0 || counts["always"] != 1 {
+		t.Errorf("Expected only the remaining handler to run on the second message, got %v", counts)
+	}
+	cleanup()
+}
+
+func TestUnsubscribeDuringDeliveryOfOtherKind(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewEventAgent()
+	running := make(chan interface{}, 1)
+	release := make(chan struct{})
+	agent.Subscribe("slow", func(e *Event) {
+		running <- 1
+		<-release
+	})
+	other := func(e *Event) {}
+	agent.Subscribe("other", other)
+
+	h.Broadcast("slow", nil, nil)
+	if _, err := waitForValueOrTimeout(running, deadline); err != nil {
+		t.Fatal("The slow handler did not run.")
+	}
+	agent.Unsubscribe("other", other)
+	if handlers, _ := agent.handlers("other"); len(handlers) != 0 {
+		t.Error("Expected a handler to be removed at once while only handlers of another kind run.")
+	}
+	close(release)
+	cleanup()
+}
+
+func TestKindQueuesRetired(t *testing.T) {
+	kinds := &kindQueues{queues: make(map[string]*kindQueue)}
+	handled := make(chan interface{}, 3)
+	for _, kind := range []string{"a", "b", "c"} {
+		kinds.push(newEvent(kind, nil), 1, func(e *Event) {
+			handled <- e.Kind
+		})
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := waitForValueOrTimeout(handled, deadline); err != nil {
+			t.Fatal("A queued event was not handled.")
+		}
+	}
+	timeout := time.Now().Add(deadline)
+	for {
+		kinds.mu.Lock()
+		n := len(kinds.queues)
+		kinds.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("Expected idle queues to be removed, %d remain.", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouteToHub(t *testing.T) {
+	h1 := createTestHub(t, "h1")
+	h2 := createTestHub(t, "h2")
+	connected := make(chan interface{}, 2)
+	tenants := map[string]*Hub{"h1": h1, "h2": h2}
+	route := func(r *http.Request) (*Hub, error) {
+		h, ok := tenants[r.Header.Get("X-Tenant")]
+		if !ok {
+			return nil, errors.New("unknown tenant")
+		}
+		return h, nil
+	}
+	server := httptest.NewServer(RouteToHub(route, func(c *Client) {
+		connected <- c
+	}))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, h := range []*Hub{h1, h2} {
+		header := http.Header{}
+		header.Set("X-Tenant", h.ID)
+		conn, _, err := websocket.DefaultDialer.Dial(u, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		value, err := waitForValueOrTimeout(connected, deadline)
+		if err != nil {
+			t.Fatal("Client was not created.")
+		}
+		if hub := value.(*Client).Events.Hub; hub != h {
+			t.Errorf("Expected the client to be routed to %s, got %s", h.ID, hub.ID)
+		}
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected an unroutable request to be rejected with 400.")
+	}
+	cleanup()
+}
+
+func TestDeduplication(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	c1.Messages.SetDeduplication(time.Minute, 16)
+	ch := make(chan interface{}, 5)
+	c1.Messages.Subscribe("order", func(m *Message) {
+		ch <- m.Data
+	})
+
+	for _, m := range []string{
+		`{"kind": "order", "idempotencyKey": "k1"}`,
+		`{"kind": "order", "idempotencyKey": "k1"}`,
+		`{"kind": "order", "idempotencyKey": "k2"}`,
+	} {
+		if err := incoming.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := waitForValueOrTimeout(ch, deadline); err != nil {
+			t.Fatal("Expected one message for each idempotency key.")
+		}
+	}
+	if _, err := waitForValueOrTimeout(ch, deadline/10); err != errTimeoutWaitingForValue {
+		t.Error("Duplicate message reached the handler.")
+	}
+	cleanup()
+}
+
+func benchmarkFamilyMembers(h *Hub, n int) []Delegate {
+	members := make([]Delegate, n)
+	for i := range members {
+		c := &Client{}
+		c.Messages = h.NewUnconnectedMessageAgent()
+		c.Events = h.NewEventAgent()
+		members[i] = c
+	}
+	return members
+}
+
+func benchmarkFamily(h *Hub, id string) *Family {
+	f := h.NewFamily(id)
+	for i := 0; i < 20; i++ {
+		kind := "kind" + strconv.Itoa(i)
+		f.Events.Subscribe(kind, func(e *Event) {})
+		f.Messages.Subscribe(kind, func(m *Message) {})
+	}
+	return f
+}
+
+func BenchmarkFamilyAdd(b *testing.B) {
+	h := DefaultHub()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f := benchmarkFamily(h, "bench"+strconv.Itoa(i))
+		members := benchmarkFamilyMembers(h, 100)
+		b.StartTimer()
+		for _, d := range members {
+			f.Add(d)
+		}
+	}
+	cleanup()
+}
+
+func BenchmarkFamilyAddAll(b *testing.B) {
+	h := DefaultHub()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f := benchmarkFamily(h, "bench"+strconv.Itoa(i))
+		members := benchmarkFamilyMembers(h, 100)
+		b.StartTimer()
+		f.AddAll(members...)
+	}
+	cleanup()
+}
+
+func TestNegotiatedExtensions(t *testing.T) {
+	_, plain := createTestClients(t, "c1", nil)
+	if extensions := plain.Messages.NegotiatedExtensions(); len(extensions) != 0 {
+		t.Error("Expected no extensions without compression, got ", extensions)
+	}
+
+	EnableCompression = true
+	defer func() {
+		EnableCompression = false
+	}()
+	_, compressed := createTestClientsWithDialer(t, "c2", nil, &websocket.Dialer{EnableCompression: true})
+	extensions := compressed.Messages.NegotiatedExtensions()
+	if len(extensions) != 1 || extensions[0] != "permessage-deflate" {
+		t.Error("Expected permessage-deflate to be negotiated, got ", extensions)
+	}
+	cleanup()
+}
+
+// applyMergePatch applies a JSON Merge Patch as a client following the SendJSONPatch contract
+// would.
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = applyMergePatch(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+func TestSendJSONPatch(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+	prev := map[string]interface{}{
+		"title":  "draft",
+		"body":   strings.Repeat("text ", 20),
+		"tags":   []string{"a", "b"},
+		"author": map[string]interface{}{"name": "ann", "role": "editor"},
+	}
+	next := map[string]interface{}{
+		"title":  "final",
+		"body":   strings.Repeat("text ", 20),
+		"author": map[string]interface{}{"name": "ann", "role": "owner"},
+	}
+	read := func() (string, interface{}) {
+		incoming.SetReadDeadline(time.Now().Add(deadline))
+		var m struct {
+			Kind string      `json:"kind"`
+			Data interface{} `json:"data"`
+		}
+		if err := incoming.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Kind, m.Data
+	}
+	decode := func(v interface{}) interface{} {
+		var doc interface{}
+		b, _ := json.Marshal(v)
+		json.Unmarshal(b, &doc)
+		return doc
+	}
+
+	if err := c1.Messages.SendJSONPatch(prev, next); err != nil {
+		t.Fatal(err)
+	}
+	kind, patch := read()
+	if kind != PatchKind {
+		t.Fatalf("Expected a %s message, got %s", PatchKind, kind)
+	}
+	if state := applyMergePatch(decode(prev), patch); !reflect.DeepEqual(state, decode(next)) {
+		t.Errorf("Applying the patch gave %v, expected %v", state, decode(next))
+	}
+
+	// a patch that replaces everything is no smaller than the state itself
+	if err := c1.Messages.SendJSONPatch(prev, map[string]interface{}{"x": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if kind, state := read(); kind != StateKind || !reflect.DeepEqual(state, decode(map[string]interface{}{"x": 1})) {
+		t.Errorf("Expected the full state, got %s %v", kind, state)
+	}
+	cleanup()
+}
+
+func TestAcceptRate(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.AcceptRate(10, 3)
+	server := httptest.NewServer(h.Handler(nil))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func() int {
+		conn, resp, err := websocket.DefaultDialer.Dial(u, nil)
+		if err == nil {
+			conn.Close()
+			return http.StatusSwitchingProtocols
+		}
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	admitted, rejected := 0, 0
+	for i := 0; i < 6; i++ {
+		switch dial() {
+		case http.StatusSwitchingProtocols:
+			admitted++
+		case http.StatusServiceUnavailable:
+			rejected++
+		}
+	}
+	if admitted != 3 || rejected != 3 {
+		t.Errorf("Expected a burst of 3 to be admitted and 3 rejected, got %d and %d", admitted, rejected)
+	}
+
+	// the bucket refills at 10 per second
+	time.Sleep(150 * time.Millisecond)
+	if status := dial(); status != http.StatusSwitchingProtocols {
+		t.Error("Expected a connection to be admitted once the rate allows, got ", status)
+	}
+	cleanup()
+}
+
+func TestClientLastError(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	if err, at := c1.LastError(); err != nil || !at.IsZero() {
+		t.Fatal("Expected no last error on a new client, got ", err)
+	}
+
+	// shutting down the server's side of the connection makes the next write fail
+	start := time.Now()
+	if err := c1.Messages.conn.(*websocket.Conn).UnderlyingConn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	c1.Messages.PushMessage([]byte(`{"kind": "test"}`), websocket.TextMessage)
+
+	timeout := time.After(deadline)
+	for {
+		err, at := c1.LastError()
+		if err != nil {
+			if at.Before(start) || at.After(time.Now()) {
+				t.Errorf("Unexpected time for the last error: %s", at)
+			}
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("The write error was not recorded as the client's last error.")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cleanup()
+}
+
+func TestSetWriteCoalesce(t *testing.T) {
+	fake := &fakeClock{now: time.Unix(1000, 0)}
+	SetClockForTesting(fake)
+	defer SetClockForTesting(nil)
+	incoming, c1 := createTestClients(t, "c1", nil)
+	c1.Messages.SetWriteCoalesce(time.Second, 64)
+	read := func() string {
+		incoming.SetReadDeadline(time.Now().Add(deadline))
+		_, m, err := incoming.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(m)
+	}
+
+	// the clock doesn't move, so small messages are held until one is too big to join them
+	big := strings.Repeat("x", 64)
+	for _, m := range []string{"a", "b", "c", big} {
+		c1.Messages.PushMessage([]byte(m), websocket.TextMessage)
+	}
+	if m := read(); m != "a\nb\nc" {
+		t.Errorf("Expected the small messages in one frame, got %q", m)
+	}
+	if m := read(); m != big {
+		t.Errorf("Expected the big message on its own, got %q", m)
+	}
+
+	// expire the first batch's window, which was flushed early
+	fake.Advance(time.Second)
+	c1.Messages.PushMessage([]byte("d"), websocket.TextMessage)
+	// the write loop waits for its next ping and for the coalesce window
+	for fake.Waiters() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(time.Second)
+	if m := read(); m != "d" {
+		t.Errorf("Expected the held message to be written when the window passed, got %q", m)
+	}
+	cleanup()
+}
+
+func TestExpectAuthFirst(t *testing.T) {
+	verify := func(token []byte) (interface{}, error) {
+		if string(token) != "secret" {
+			return nil, errors.New("bad token")
+		}
+		return "alice", nil
+	}
+	received := make(chan interface{}, 1)
+
+	incoming, c1 := createTestClients(t, "c1", nil)
+	c1.Messages.ExpectAuthFirst(deadline, verify)
+	c1.Messages.Subscribe("hello", func(m *Message) {
+		received <- m
+	})
+	for _, m := range []string{"secret", `{"kind":"hello"}`} {
+		if err := incoming.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := waitForValueOrTimeout(received, deadline); err != nil {
+		t.Fatal("The message after a valid auth frame was not handled.")
+	}
+	if identity, _ := c1.Metadata(IdentityKey); identity != "alice" {
+		t.Error("Expected the identity to be stored in metadata, got ", identity)
+	}
+
+	incoming2, c2 := createTestClients(t, "c2", nil)
+	c2.Messages.ExpectAuthFirst(deadline, verify)
+	if err := incoming2.WriteMessage(websocket.TextMessage, []byte("wrong")); err != nil {
+		t.Fatal(err)
+	}
+	incoming2.SetReadDeadline(time.Now().Add(deadline))
+	_, _, err := incoming2.ReadMessage()
+	if !websocket.IsCloseError(err, CloseAuthFailed) {
+		t.Error("Expected an invalid auth frame to close the connection with CloseAuthFailed, got ", err)
+	}
+	if _, ok := c2.Metadata(IdentityKey); ok {
+		t.Error("An identity was stored for a client that failed to authenticate.")
+	}
+
+	incoming3, c3 := createTestClients(t, "c3", nil)
+	c3.Messages.ExpectAuthFirst(50*time.Millisecond, verify)
+	incoming3.SetReadDeadline(time.Now().Add(deadline))
+	if _, _, err := incoming3.ReadMessage(); !websocket.IsCloseError(err, CloseAuthFailed) {
+		t.Error("Expected a client that sent nothing to be closed with CloseAuthFailed, got ", err)
+	}
+	cleanup()
+}
+
+func TestAuthFirstOption(t *testing.T) {
+	verify := func(token []byte) (interface{}, error) {
+		if string(token) != "secret" {
+			return nil, errors.New("bad token")
+		}
+		return "alice", nil
+	}
+	fake := &fakeClock{now: time.Unix(1000, 0)}
+	SetClockForTesting(fake)
+	defer SetClockForTesting(nil)
+	h := createTestHub(t, "h1")
+	clients := make(chan *Client, 3)
+	server := httptest.NewServer(h.Handler(func(c *Client) {
+		clients <- c
+	}, AuthFirstOption(time.Second, verify)))
+	defer server.Close()
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// the token is sent before the server has had any chance to set up the client
+	conn := dial()
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	c1 := <-clients
+	timeout := time.Now().Add(deadline)
+	for {
+		if identity, _ := c1.Metadata(IdentityKey); identity == "alice" {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatal("Expected a token sent right after dialing to authenticate the client.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn2 := dial()
+	defer conn2.Close()
+	if err := conn2.WriteMessage(websocket.TextMessage, []byte("wrong")); err != nil {
+		t.Fatal(err)
+	}
+	conn2.SetReadDeadline(time.Now().Add(deadline))
+	if _, _, err := conn2.ReadMessage(); !websocket.IsCloseError(err, CloseAuthFailed) {
+		t.Error("Expected an invalid first frame to close the connection with CloseAuthFailed, got ", err)
+	}
+	<-clients
+
+	// the timeout is measured by the package clock
+	waiters := fake.Waiters()
+	conn3 := dial()
+	defer conn3.Close()
+	<-clients
+	// the write loop waits for its first ping, and the read loop for the auth timeout
+	for fake.Waiters() < waiters+2 {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(time.Second)
+	conn3.SetReadDeadline(time.Now().Add(deadline))
+	if _, _, err := conn3.ReadMessage(); !websocket.IsCloseError(err, CloseAuthFailed) {
+		t.Error("Expected a client that sent nothing to be closed with CloseAuthFailed, got ", err)
+	}
+	cleanup()
+}
+
+func TestSetBroadcastBatching(t *testing.T) {
+	fake := &fakeClock{now: time.Unix(1000, 0)}
+	SetClockForTesting(fake)
+	defer SetClockForTesting(nil)
+	incoming, c1 := createTestClients(t, "c1", nil)
+	c1.Messages.SetBroadcastBatching(100 * time.Millisecond)
+
+	for i, kind := range []string{"a", "b", "a"} {
+		if err := c1.Messages.SendEvent(&Event{Kind: kind, Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.Advance(100 * time.Millisecond)
+
+	expected := `{"kind":"batch","data":[{"kind":"a","data":0},{"kind":"b","data":1},{"kind":"a","data":2}]}`
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	_, m, err := incoming.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != expected {
+		t.Errorf("Expected the events in one batch.  Expected %s, got %s", expected, m)
+	}
+	cleanup()
+}
+
+// run with -race to verify
+func TestClientGetID(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if id := c1.GetID(); !strings.HasPrefix(id, "c") {
+					t.Error("Unexpected ID: ", id)
+					return
+				}
+				Locate(c1.GetID())
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		c1.SetID(fmt.Sprintf("c%d", i))
+	}
+	close(done)
+	wg.Wait()
+
+	if c, _, ok := Locate("c99"); !ok || c != c1 || c1.GetID() != "c99" {
+		t.Error("Expected the client to be found by its new ID.")
+	}
+	if _, _, ok := Locate("c98"); ok {
+		t.Error("The client should no longer be found by its old ID.")
+	}
+	cleanup()
+}
+
+func TestPushMessageFrameType(t *testing.T) {
+	incoming, c1 := createTestClients(t, "c1", nil)
+
+	for _, mtype := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+		c1.Messages.PushMessage([]byte("frame"), mtype)
+		incoming.SetReadDeadline(time.Now().Add(deadline))
+		got, _, err := incoming.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != mtype {
+			t.Errorf("Pushed a message of type %d, but the frame had type %d.", mtype, got)
+		}
+	}
+	cleanup()
+}
+
+// fakeConn is a Conn that reads frames from inbound and records the frames written to it.
+type fakeConn struct {
+	inbound chan []byte
+	written chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		inbound: make(chan []byte, 5),
+		written: make(chan []byte, 5),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.inbound:
+		return websocket.TextMessage, m, nil
+	case <-c.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *fakeConn) WriteMessage(mtype int, data []byte) error {
+	select {
+	case c.written <- data:
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *fakeConn) WriteControl(mtype int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+func (c *fakeConn) NextWriter(mtype int) (io.WriteCloser, error) {
+	return nil, errNotYetImplemented
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error                   { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error                  { return nil }
+func (c *fakeConn) SetReadLimit(limit int64)                            {}
+func (c *fakeConn) SetPongHandler(h func(string) error)                 {}
+func (c *fakeConn) SetCloseHandler(h func(code int, text string) error) {}
+func (c *fakeConn) EnableWriteCompression(enable bool)                  {}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestAttachFakeConn(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewUnconnectedMessageAgent()
+	conn := newFakeConn()
+	defer conn.Close()
+	received := make(chan interface{}, 1)
+	agent.Subscribe("hello", func(m *Message) {
+		received <- m
+		agent.PushMessage([]byte(`{"kind":"welcome"}`), websocket.TextMessage)
+	})
+
+	if err := agent.Attach(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.inbound <- []byte(`{"kind":"hello"}`)
+	if _, err := waitForValueOrTimeout(received, deadline); err != nil {
+		t.Fatal("The message read from the fake connection was not handled.")
+	}
+	select {
+	case m := <-conn.written:
+		if string(m) != `{"kind":"welcome"}` {
+			t.Errorf("Unexpected frame written: %s", m)
+		}
+	case <-time.After(deadline):
+		t.Fatal("Nothing was written to the fake connection.")
+	}
+	cleanup()
+}
+
+func TestCleanupWithPendingMessages(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewUnconnectedMessageAgent()
+	// nothing reads what is written, so the first write blocks and the rest stay queued
+	conn := newFakeConn()
+	conn.written = make(chan []byte)
+	if err := agent.Attach(conn); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		agent.PushMessage([]byte(strconv.Itoa(i)), websocket.TextMessage)
+	}
+
+	cleaned := make(chan interface{}, 1)
+	go func() {
+		agent.cleanup()
+		cleaned <- true
+	}()
+	if _, err := waitForValueOrTimeout(cleaned, deadline); err != nil {
+		t.Fatal("cleanup blocked with messages pending.")
+	}
+	if queued := len(agent.sendText); queued < 4 {
+		t.Errorf("Expected cleanup to leave the queued messages alone, %d of 4 remain.", queued)
+	}
+	select {
+	case <-agent.done:
+	default:
+		t.Error("cleanup did not mark the agent done.")
+	}
+	cleanup()
+}
+
+func TestRedeliverDeadLetter(t *testing.T) {
+	h := createTestHub(t, "h1")
+	if err := SendToClientGlobal("deadLetterUser", []byte("while you were out"), websocket.TextMessage); err != ErrClientNotFound {
+		t.Fatal("Expected ErrClientNotFound, got ", err)
+	}
+	letters := DeadLetters(1)
+	if len(letters) != 1 || letters[0].ClientID != "deadLetterUser" || string(letters[0].Payload) != "while you were out" {
+		t.Fatal("Expected the undelivered message to be dead-lettered, got ", letters)
+	}
+	dl := letters[0]
+	if dl.Err != ErrClientNotFound {
+		t.Error("Expected the dead letter to record why it wasn't delivered, got ", dl.Err)
+	}
+	if err := RedeliverDeadLetter(dl); err != ErrClientNotFound {
+		t.Error("Expected ErrClientNotFound before the client reconnects, got ", err)
+	}
+
+	incoming, _ := createTestClients(t, "deadLetterUser", h)
+	if err := RedeliverDeadLetter(dl); err != nil {
+		t.Fatal(err)
+	}
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	if _, m, err := incoming.ReadMessage(); err != nil || string(m) != "while you were out" {
+		t.Error("Expected the client to receive the redelivered message, got ", string(m), err)
+	}
+	for _, l := range DeadLetters(maxDeadLetters) {
+		if l.ID == dl.ID {
+			t.Error("Redelivered dead letters should no longer be retained.")
+		}
+	}
+
+	cleanup()
+}
+
+func TestClientClose(t *testing.T) {
+	h := createTestHub(t, "h1")
+	f := createTestFamily(t, "f1", h)
+	incoming, c := createTestClients(t, "closingUser", h)
+	ch := make(chan interface{}, 1)
+	c.Events.Subscribe("afterClose", func(e *Event) {
+		ch <- 1
+	})
+	c.Join(f)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the dialer acknowledges the close frame when it reads it
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	if _, _, err := incoming.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Error("Expected a normal closure, got ", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		c.Messages.loops.Wait()
+		close(stopped)
+	}()
+	if _, err := waitForValueOrTimeout(doneChannel(stopped), deadline); err != nil {
+		t.Fatal("Expected the read and write loops to exit: ", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Error("Closing again should not fail, got ", err)
+	}
+
+	if c.BelongsTo(f) {
+		t.Error("A closed client should leave its families.")
+	}
+	<-h.BroadcastAck("afterClose", nil, nil)
+	if len(ch) != 0 {
+		t.Error("A closed client should not handle events.")
+	}
+	cleanup()
+}
+
+func TestHubMaxEventKinds(t *testing.T) {
+	h := createTestHub(t, "h1")
+	h.MaxEventKinds = 2
+	agent := h.NewEventAgent()
+	ch := make(chan interface{}, 4)
+	handlerFor := func(name string) EventHandler {
+		return func(e *Event) {
+			ch <- name
+		}
+	}
+
+	if err := agent.SubscribeKeyed("k1", "a", handlerFor("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.SubscribeKeyed("k2", "a", handlerFor("k2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.SubscribeKeyed("k3", "a", handlerFor("k3")); err != ErrTooManyEventKinds {
+		t.Fatal("Expected ErrTooManyEventKinds for a kind beyond the cap, got ", err)
+	}
+	if err := agent.SubscribeKeyed("k1", "b", handlerFor("k1")); err != nil {
+		t.Error("Existing kinds should still accept handlers, got ", err)
+	}
+	if h.HasSubscribers("k3") {
+		t.Error("The rejected kind should not be subscribed.")
+	}
+	if _, ok := agent.handlers("k3"); ok {
+		t.Error("The agent should not keep the rejected handler.")
+	}
+
+	<-h.BroadcastAck("k1", nil, nil)
+	<-h.BroadcastAck("k2", nil, nil)
+	<-h.BroadcastAck("k3", nil, nil)
+	if len(ch) != 3 {
+		t.Errorf("Expected the existing kinds to keep working, %d handlers ran.", len(ch))
+	}
+
+	agent.UnsubscribeKeyed("k2", "a")
+	if err := agent.SubscribeKeyed("k3", "a", handlerFor("k3")); err != nil {
+		t.Error("Kinds without subscribers should not count toward the cap, got ", err)
+	}
+	cleanup()
+}
+
+func TestOnDisconnect(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewUnconnectedMessageAgent()
+	conn := newFakeConn()
+	reasons := make(chan interface{}, 2)
+	agent.OnDisconnect(func(reason error) {
+		reasons <- reason
+	})
+	if err := agent.Attach(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+	reason, err := waitForValueOrTimeout(reasons, deadline)
+	if err != nil {
+		t.Fatal("Expected the callback to run when the connection dies: ", err)
+	}
+	if reason != io.EOF {
+		t.Error("Expected the read error as the reason, got ", reason)
+	}
+	agent.loops.Wait()
+	if len(reasons) != 0 {
+		t.Error("The callback should run only once.")
+	}
+
+	incoming, c := createTestClients(t, "leavingUser", h)
+	c.OnDisconnect(func(reason error) {
+		reasons <- reason
+	})
+	c.Close()
+	incoming.SetReadDeadline(time.Now().Add(deadline))
+	incoming.ReadMessage()
+	reason, err = waitForValueOrTimeout(reasons, deadline)
+	if err != nil {
+		t.Fatal("Expected the callback to run when the client is closed: ", err)
+	}
+	if !websocket.IsCloseError(reason.(error), websocket.CloseNormalClosure) {
+		t.Error("Expected a normal closure as the reason, got ", reason)
+	}
+	cleanup()
+}
+
+func TestFamilyNotifyOnLeave(t *testing.T) {
+	h := createTestHub(t, "h1")
+	f := createTestFamily(t, "f1", h)
+	f.NotifyOnLeave = true
+	incoming1, c1 := createTestClients(t, "departing", h)
+	_, c2 := createTestClients(t, "staying", h)
+	_, c3 := createTestClients(t, "closed", h)
+	c1.Join(f)
+	c2.Join(f)
+	c3.Join(f)
+	left := make(chan interface{}, 2)
+	c2.Events.Subscribe(MemberLeftKind, func(e *Event) {
+		left <- e.Data
+	})
+
+	incoming1.Close()
+	data, err := waitForValueOrTimeout(left, deadline)
+	if err != nil {
+		t.Fatal("Expected the remaining member to be told that a member left: ", err)
+	}
+	if ml, ok := data.(*MemberLeft); !ok || ml.ID != c1.GetID() || ml.Reason == "" {
+		t.Error("Expected the departed client's ID and close reason, got ", data)
+	}
+	if _, err := waitForValueOrTimeout(doneChannel(c1.Messages.done), deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	c3.Close()
+	data, err = waitForValueOrTimeout(left, deadline)
+	if err != nil {
+		t.Fatal("Expected the remaining member to be told that a closed member left: ", err)
+	}
+	if ml, ok := data.(*MemberLeft); !ok || ml.ID != c3.GetID() || ml.Code != websocket.CloseNormalClosure {
+		t.Error("Expected the closed client's ID and a normal closure, got ", data)
+	}
+	if len(left) != 0 {
+		t.Error("Each departure should be reported once.")
+	}
+	cleanup()
+}
+
+func TestConnectionContextOutlivesRequest(t *testing.T) {
+	type key struct{}
+	request, cancelRequest := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	ctx, cancel := context.WithCancel(valuesContext{request})
+	defer cancel()
+
+	cancelRequest()
+	if ctx.Err() != nil {
+		t.Error("The connection's context should not be cancelled with the request's.")
+	}
+	if ctx.Value(key{}) != "value" {
+		t.Error("Expected the connection's context to carry the request's values.")
+	}
+}
+
+func TestRegisterDisconnectedAgent(t *testing.T) {
+	h := createTestHub(t, "h1")
+	agent := h.NewUnconnectedMessageAgent()
+	// the connection is lost while the client is still being set up
+	agent.Close()
+	agent.register()
+	h.mu.RLock()
+	_, ok := h.agents[agent]
+	h.mu.RUnlock()
+	if ok {
+		t.Error("Expected an agent that disconnected before registering not to be kept by the hub.")
+	}
+	cleanup()
+}
+
+func TestClientCloseClearsEventSubscriptions(t *testing.T) {
+	h := createTestHub(t, "h1")
+	_, c1 := createTestClients(t, "c1", h)
+	c1.Events.Subscribe("e1", func(e *Event) {})
+	c1.Events.SubscribeWithPolicy("e2", Concurrent, func(e *Event) {})
+	c1.Close()
+
+	if snapshot := c1.SubscriptionSnapshot(); len(snapshot.Events) != 0 {
+		t.Error("Expected a closed client to have no event subscriptions, got ", snapshot.Events)
+	}
+	if handlers, ok := c1.Events.handlers("e1"); ok || len(handlers) != 0 {
+		t.Error("Expected a closed client's event handlers to be removed.")
+	}
+	h.mu.RLock()
+	_, subscribed := h.eventAgents[c1.Events.events]
+	_, dropped := h.droppedSeqs[c1.Events.events]
+	h.mu.RUnlock()
+	if subscribed || dropped {
+		t.Error("Expected the hub to forget a closed client's event agent.")
+	}
+	cleanup()
 }
@@ -0,0 +1,130 @@
+package artemis
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CloseAuthFailed is the close code sent to a client whose first frame did not authenticate it,
+// see MessageAgent.ExpectAuthFirst.
+const CloseAuthFailed = 4001
+
+// IdentityKey is the metadata key under which ExpectAuthFirst stores a client's identity.
+const IdentityKey = "identity"
+
+// ErrAuthTimeout is reported when a client that was expected to authenticate with its first frame
+// sent nothing before the timeout.
+var ErrAuthTimeout = errors.New("Client did not authenticate before the timeout.")
+
+// firstFrameAuth holds the verification of the next frame that the agent receives.
+type firstFrameAuth struct {
+	verify  func([]byte) (interface{}, error)
+	timeout time.Duration
+	// settled is closed once the frame has been verified, the timeout has passed or the auth has
+	// been replaced
+	settled chan struct{}
+	arm     sync.Once
+}
+
+// ExpectAuthFirst treats the next frame that the agent receives as an auth token instead of a
+// message.  The frame is passed to verify, and if it succeeds, the identity it returns is stored
+// in the client's metadata under IdentityKey, and the frames that follow are handled as usual.  If
+// verify fails, or no frame arrives within timeout, the connection is closed with CloseAuthFailed.
+// A timeout of 0 waits indefinitely, and the timeout starts once the agent is reading.
+//
+// Frames that were received before the call are not verified.  Use AuthFirstOption to expect auth
+// from a client's very first frame.
+func (agent *MessageAgent) ExpectAuthFirst(timeout time.Duration, verify func([]byte) (identity interface{}, err error)) {
+	auth := &firstFrameAuth{verify: verify, timeout: timeout, settled: make(chan struct{})}
+	agent.authMu.Lock()
+	if agent.auth != nil {
+		close(agent.auth.settled)
+	}
+	agent.auth = auth
+	agent.authMu.Unlock()
+	// if the read loop has not started, it starts the timeout instead
+	if atomic.LoadInt32(&agent.readStarted) == 1 {
+		agent.armAuth(auth)
+	}
+}
+
+// AuthFirstOption makes each client that the handler creates expect auth from its first frame,
+// see MessageAgent.ExpectAuthFirst.  Unlike calling ExpectAuthFirst from onConnect, no frame can
+// arrive before the client is waiting for auth.
+func AuthFirstOption(timeout time.Duration, verify func([]byte) (identity interface{}, err error)) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.authTimeout = timeout
+		cfg.authVerify = verify
+	}
+}
+
+// armPendingAuth starts the timeout of the auth that the agent is waiting for, if any.  It runs
+// when the read loop starts.
+func (agent *MessageAgent) armPendingAuth() {
+	atomic.StoreInt32(&agent.readStarted, 1)
+	agent.authMu.Lock()
+	auth := agent.auth
+	agent.authMu.Unlock()
+	if auth != nil {
+		agent.armAuth(auth)
+	}
+}
+
+// armAuth starts the timeout of auth, unless it has already been started.
+func (agent *MessageAgent) armAuth(auth *firstFrameAuth) {
+	if auth.timeout <= 0 {
+		return
+	}
+	auth.arm.Do(func() {
+		go agent.expireAuth(auth)
+	})
+}
+
+// expireAuth closes the connection if auth is still pending once its timeout has passed.
+func (agent *MessageAgent) expireAuth(auth *firstFrameAuth) {
+	select {
+	case <-after(auth.timeout):
+		if agent.takeAuth(auth) {
+			agent.throw(ErrAuthTimeout)
+			agent.disconnect(CloseAuthFailed)
+		}
+	case <-auth.settled:
+	case <-agent.done:
+	}
+}
+
+// takeAuth clears the pending auth if it is still auth, and reports whether it did, so that
+// either the first frame or the timeout settles it, but not both.
+func (agent *MessageAgent) takeAuth(auth *firstFrameAuth) bool {
+	agent.authMu.Lock()
+	defer agent.authMu.Unlock()
+	if agent.auth != auth {
+		return false
+	}
+	close(auth.settled)
+	agent.auth = nil
+	return true
+}
+
+// authenticate verifies m if the agent is waiting for an auth frame, and reports whether m was
+// consumed as one.
+func (agent *MessageAgent) authenticate(m []byte) bool {
+	agent.authMu.Lock()
+	auth := agent.auth
+	agent.authMu.Unlock()
+	if auth == nil || !agent.takeAuth(auth) {
+		return false
+	}
+	identity, err := auth.verify(m)
+	if err != nil {
+		agent.throw(err)
+		agent.disconnect(CloseAuthFailed)
+		return true
+	}
+	if c, ok := agent.GetDelegate().(*Client); ok {
+		c.SetMetadata(IdentityKey, identity)
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package artemis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// circuitBreaker stops dispatching a kind after its handlers panic threshold times within window,
+// until cooldown has passed.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	panics    map[string][]time.Time
+	openUntil map[string]time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	cb := &circuitBreaker{}
+	cb.threshold = threshold
+	cb.window = window
+	cb.cooldown = cooldown
+	cb.panics = make(map[string][]time.Time)
+	cb.openUntil = make(map[string]time.Time)
+
+	return cb
+}
+
+// allow reports whether handlers for kind may be run.
+func (cb *circuitBreaker) allow(kind string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	until, ok := cb.openUntil[kind]
+	if !ok {
+		return true
+	}
+	if time.Now().Before(until) {
+		return false
+	}
+	delete(cb.openUntil, kind)
+	return true
+}
+
+func (cb *circuitBreaker) recordPanic(kind string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	recent := cb.panics[kind][:0]
+	for _, t := range cb.panics[kind] {
+		if now.Sub(t) < cb.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < cb.threshold {
+		cb.panics[kind] = recent
+		return
+	}
+
+	delete(cb.panics, kind)
+	cb.openUntil[kind] = now.Add(cb.cooldown)
+	warn(fmt.Errorf("Handlers for '%s' panicked %d times, not dispatching for %v.", kind, len(recent), cb.cooldown))
+}
+
+// SetHandlerCircuitBreaker stops the hub from dispatching messages and events of a kind for
+// cooldown, once handlers for that kind have panicked threshold times within window.  A threshold
+// of 0 disables the circuit breaker.
+func (h *Hub) SetHandlerCircuitBreaker(threshold int, window, cooldown time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if threshold <= 0 {
+		h.breaker = nil
+		return
+	}
+	h.breaker = newCircuitBreaker(threshold, window, cooldown)
+}
+
+func (h *Hub) circuitBreaker() *circuitBreaker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.breaker
+}
+
+// allowDispatch reports whether handlers for kind may be run.
+func (h *Hub) allowDispatch(kind string) bool {
+	if cb := h.circuitBreaker(); cb != nil {
+		return cb.allow(kind)
+	}
+	return true
+}
+
+// SetHandlerConcurrency limits the number of handlers that the hub's agents may run at once to n.
+// Handlers beyond the limit wait for a running handler to finish.  Handlers that run on goroutines
+// of their own, such as those subscribed with the Concurrent policy, hold their place from before
+// the goroutine is started, so the limit also caps those goroutines.  Handlers delivered inline by
+// SynchronousDelivery run on the goroutine that broadcast the event, which may already be running
+// a handler, so they are not limited.  An n of 0 or less removes the limit.  It should be set
+// before the hub's agents start handling messages or events.
+func (h *Hub) SetHandlerConcurrency(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n <= 0 {
+		h.handlerSlots = nil
+		return
+	}
+	h.handlerSlots = make(chan struct{}, n)
+}
+
+// RunningHandlers returns the number of handlers that the hub's agents are running.
+func (h *Hub) RunningHandlers() int64 {
+	return atomic.LoadInt64(&h.runningHandlers)
+}
+
+// handlerSlot is a place among the handlers that SetHandlerConcurrency allows to run at once.
+type handlerSlot struct {
+	slots    chan struct{}
+	released int32
+}
+
+// acquireHandlerSlot waits for a place to run a handler.  The slot must be released.
+func (h *Hub) acquireHandlerSlot() *handlerSlot {
+	h.mu.RLock()
+	slots := h.handlerSlots
+	h.mu.RUnlock()
+	if slots != nil {
+		slots <- struct{}{}
+	}
+	return &handlerSlot{slots: slots}
+}
+
+// release gives up the slot, unless it has already been released or transferred.
+func (s *handlerSlot) release() {
+	if atomic.CompareAndSwapInt32(&s.released, 0, 1) && s.slots != nil {
+		<-s.slots
+	}
+}
+
+// transfer hands the slot over to a new holder, so that a handler can pass its place on to the
+// goroutine it starts rather than wait for another.  Releasing the old holder does nothing.
+func (s *handlerSlot) transfer() *handlerSlot {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return nil
+	}
+	return &handlerSlot{slots: s.slots}
+}
+
+// runHandler runs a handler for kind once there is a slot for it, see SetHandlerConcurrency.
+func (h *Hub) runHandler(kind string, recipient interface{}, parent context.Context, run func(context.Context)) {
+	slot := h.acquireHandlerSlot()
+	defer slot.release()
+	h.execHandler(kind, recipient, parent, run)
+}
+
+// execHandler runs a handler for kind, recovering from and reporting any panic.  run is passed a
+// context derived from parent, which is cancelled by CancelInFlight or once run returns.  The
+// caller is responsible for the handler's slot, if it needs one.
+func (h *Hub) execHandler(kind string, recipient interface{}, parent context.Context, run func(context.Context)) {
+	atomic.AddInt64(&h.runningHandlers, 1)
+	defer atomic.AddInt64(&h.runningHandlers, -1)
+	ctx, done := h.trackHandler(kind, recipient, parent)
+	defer done()
+
+	defer func() {
+		if r := recover(); r != nil {
+			throw(fmt.Errorf("Handler for '%s' panicked: %v", kind, r))
+			if cb := h.circuitBreaker(); cb != nil {
+				cb.recordPanic(kind)
+			}
+		}
+	}()
+	run(ctx)
+}
@@ -1,16 +1,88 @@
 package artemis
 
-import "net/http"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrTriggerRateExceeded indicates that a client tried to trigger events faster than its
+	// trigger rate allows.
+	ErrTriggerRateExceeded = errors.New("Client exceeded its trigger rate, event was dropped.")
+
+	// ErrTooManyFamilies indicates that joining families would put a client in more families than
+	// its hub's MaxFamiliesPerClient allows.
+	ErrTooManyFamilies = errors.New("Client would belong to too many families.")
+)
+
+// TriggerOptions controls how TriggerWith fires an event.
+type TriggerOptions struct {
+	// IncludeSelf runs the triggering client's own handlers for the event.  Trigger always does.
+	IncludeSelf bool
+}
 
 type Client struct {
+	// ID is assigned by SessionIDGenerator when the client is created, and kept up to date by
+	// SetID.  Assigning to it has no effect on GetID or Locate.
+	//
+	// Deprecated: ID is read-only and reading it while the ID is being changed is a data race.  Use
+	// GetID and SetID instead.
 	ID string
+	// id holds the current ID as a string, see GetID
+	id atomic.Value
 
 	Messages *MessageAgent
 	Events   *EventAgent
+
+	triggerLimit *tokenBucket
+
+	metadataMu sync.RWMutex
+	metadata   map[string]interface{}
+
+	// joinMu makes checking MaxFamiliesPerClient and joining atomic, see Join
+	joinMu sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+	// leaveNotified is set once the client's families have been told that it left
+	leaveNotified int32
+}
+
+func NewClient(w http.ResponseWriter, r *http.Request, opts ...HandlerOption) (*Client, error) {
+	return DefaultHub().NewClient(w, r, opts...)
 }
 
-func NewClient(w http.ResponseWriter, r *http.Request) (*Client, error) {
-	return DefaultHub().NewClient(w, r)
+// LastError returns the most recent error reported for the client's connection, such as a failed
+// write or an unparseable message, and when it was reported.  It returns nil and the zero time if
+// there has been none.
+func (c *Client) LastError() (error, time.Time) {
+	return c.Messages.lastError()
+}
+
+// OnDisconnect adds a callback that runs once the client's connection is lost, with the reason
+// it was lost.  See MessageAgent.OnDisconnect.
+func (c *Client) OnDisconnect(do func(reason error)) {
+	c.Messages.OnDisconnect(do)
+}
+
+// GetID returns the client's ID.  It is safe to call while the ID is being changed.
+func (c *Client) GetID() string {
+	if id, ok := c.id.Load().(string); ok {
+		return id
+	}
+	return c.ID
+}
+
+// SetID changes the client's ID.  It is safe to call while the ID is being read with GetID.  The
+// ID field is updated too, for compatibility.
+func (c *Client) SetID(id string) {
+	renameInDirectory(c, id)
 }
 
 func (c *Client) EventAgent() *EventAgent {
@@ -21,24 +93,304 @@ func (c *Client) MessageAgent() *MessageAgent {
 	return c.Messages
 }
 
+// Metadata returns the value stored for key, such as the identity found by the hub's
+// AuthExtractor.
+func (c *Client) Metadata(key string) (interface{}, bool) {
+	c.metadataMu.RLock()
+	defer c.metadataMu.RUnlock()
+	value, ok := c.metadata[key]
+	return value, ok
+}
+
+// SetMetadata stores value for key, replacing any value already stored.
+func (c *Client) SetMetadata(key string, value interface{}) {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+	if c.metadata == nil {
+		c.metadata = make(map[string]interface{})
+	}
+	c.metadata[key] = value
+}
+
+// CapabilitiesKey is the metadata key under which a client's capabilities are stored, as a
+// []string or, when decoded from JSON, a []interface{} of strings.
+const CapabilitiesKey = "capabilities"
+
+// SetCapabilities stores the capabilities that the client advertises, e.g. from a handshake
+// message, replacing any it had.
+func (c *Client) SetCapabilities(capabilities ...string) {
+	c.SetMetadata(CapabilitiesKey, capabilities)
+}
+
+// HasCapability reports whether the client advertises capability in its metadata.
+func (c *Client) HasCapability(capability string) bool {
+	value, _ := c.Metadata(CapabilitiesKey)
+	switch capabilities := value.(type) {
+	case []string:
+		for _, have := range capabilities {
+			if have == capability {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, have := range capabilities {
+			if have == capability {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Trigger broadcasts an event to the client's hub, with the client as the source.  If the client
+// has exceeded its trigger rate, the event is dropped with a warning.
 func (c *Client) Trigger(eventKind string, data DataGetter) {
-	c.Events.Hub.Broadcast(eventKind, data, c)
+	if err := c.TryTrigger(eventKind, data); err != nil {
+		warn(err)
+	}
+}
+
+// TryTrigger is like Trigger, but returns ErrTriggerRateExceeded rather than warning when the
+// event is dropped.
+func (c *Client) TryTrigger(eventKind string, data DataGetter) error {
+	return c.TriggerWith(eventKind, data, TriggerOptions{IncludeSelf: true})
+}
+
+// TriggerWith is like TryTrigger, with opts controlling how the event is fired.
+func (c *Client) TriggerWith(eventKind string, data DataGetter, opts TriggerOptions) error {
+	if c.triggerLimit != nil && !c.triggerLimit.allow() {
+		return ErrTriggerRateExceeded
+	}
+	var filter subscriberFilter
+	if !opts.IncludeSelf {
+		filter = excluding(c.Events.events)
+	}
+	c.Events.Hub.broadcast(eventKind, data, c, nil, filter)
+	return nil
+}
+
+// SetTriggerRate limits the client to triggering perSecond events on average, with bursts of up
+// to burst events.  A perSecond of 0 or less removes the limit.  It should be set before the
+// client starts triggering events.
+func (c *Client) SetTriggerRate(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		c.triggerLimit = nil
+		return
+	}
+	c.triggerLimit = newTokenBucket(perSecond, burst)
+}
+
+// TriggerFamilies fires an event to the members of every family the client belongs to, including
+// the client itself if it subscribes to kind.  Members of more than one of those families receive
+// the event once.
+func (c *Client) TriggerFamilies(eventKind string, data DataGetter) {
+	var agents map[*EventAgent]struct{}
+	for _, f := range c.Families() {
+		agents = f.eventAgents(agents)
+	}
+	deliver(c.Events.Hub, agents, eventKind, data, c)
+}
+
+// Families returns the families in the client's hub that the client belongs to.
+func (c *Client) Families() []*Family {
+	var families []*Family
+	for _, f := range c.Events.Hub.allFamilies() {
+		if c.BelongsTo(f) {
+			families = append(families, f)
+		}
+	}
+
+	return families
 }
 
 func (c *Client) PushMessage(m []byte, mtype int) {
 	c.Messages.PushMessage(m, mtype)
 }
 
-func (c *Client) Join(families ...*Family) {
+// SendJSON encodes v with Marshaler and sends it to the client as a text message.
+func (c *Client) SendJSON(v interface{}) error {
+	return c.Messages.SendJSON(v)
+}
+
+// SendError sends a protocol-level error reply to the client.  See ErrorEnvelope.
+func (c *Client) SendError(code, message string, relatedTo *Message) error {
+	return c.Messages.SendError(code, message, relatedTo)
+}
+
+// Join adds the client to families.  If that would put the client in more families than its
+// hub's MaxFamiliesPerClient, it joins none of them and returns ErrTooManyFamilies.  Concurrent
+// calls to Join for the same client are serialized, so together they can't exceed the limit.
+func (c *Client) Join(families ...*Family) error {
+	c.joinMu.Lock()
+	defer c.joinMu.Unlock()
+	if max := c.Events.Hub.MaxFamiliesPerClient; max > 0 {
+		joining := make(map[*Family]struct{})
+		for _, f := range families {
+			if !f.hasMember(c) {
+				joining[f] = struct{}{}
+			}
+		}
+		if len(c.Families())+len(joining) > max {
+			return ErrTooManyFamilies
+		}
+	}
 	for _, f := range families {
-		f.Add(c)
+		if err := f.Add(c); err != nil {
+			warn(err)
+		}
 	}
+	return nil
 }
 
 func (c *Client) Leave(f *Family) {
 	f.Remove(c)
 }
 
+// JoinByID adds the client to the families in its hub with the given IDs.  Warns with
+// ErrFamilyNotFound for IDs that don't match a family, and with ErrTooManyFamilies for families
+// beyond the hub's MaxFamiliesPerClient.
+func (c *Client) JoinByID(ids ...string) {
+	for _, id := range ids {
+		if f, ok := c.Events.Hub.Family(id); ok {
+			if err := c.Join(f); err != nil {
+				warn(err)
+			}
+		} else {
+			warn(ErrFamilyNotFound)
+		}
+	}
+}
+
+// LeaveByID removes the client from the family in its hub with the given ID.  Warns with
+// ErrFamilyNotFound if there is no such family.
+func (c *Client) LeaveByID(id string) {
+	if f, ok := c.Events.Hub.Family(id); ok {
+		c.Leave(f)
+	} else {
+		warn(ErrFamilyNotFound)
+	}
+}
+
+// Close disconnects the client: it leaves every family it belongs to, stops receiving events from
+// its hub, and closes its connection with a normal closure.  It returns the error from sending the
+// close frame, if any.  Families with NotifyOnLeave are told that it left with a normal closure.
+// Close may be called more than once, from any goroutine; later calls return the result of the
+// first.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		notify := atomic.CompareAndSwapInt32(&c.leaveNotified, 0, 1)
+		families := c.Families()
+		for _, f := range families {
+			c.Leave(f)
+		}
+		c.Events.unsubscribeAll()
+		c.closeErr = c.Messages.Close()
+		if notify {
+			reason := &websocket.CloseError{Code: websocket.CloseNormalClosure}
+			for _, f := range families {
+				f.memberLeft(c, reason)
+			}
+		}
+	})
+	return c.closeErr
+}
+
+// notifyFamilies tells the families that the client belongs to that it has disconnected, see
+// Family.NotifyOnLeave.
+func (c *Client) notifyFamilies(reason error) {
+	if !atomic.CompareAndSwapInt32(&c.leaveNotified, 0, 1) {
+		return
+	}
+	for _, f := range c.Families() {
+		f.memberLeft(c, reason)
+	}
+}
+
 func (c *Client) BelongsTo(f *Family) bool {
 	return f.hasMember(c)
 }
+
+// Snapshot records the kinds a client subscribes to, so that the subscriptions can be restored
+// onto a new client, e.g. after a reconnect.  Handlers can't be serialized, so each is referenced
+// by a token.  A snapshot taken in the current process is bound to its handlers already; one that
+// has been deserialized must have its tokens bound with BindEvent and BindMessage before restoring.
+type Snapshot struct {
+	// Events and Messages map each subscribed kind to the tokens of its handlers.
+	Events   map[string][]string `json:"events"`
+	Messages map[string][]string `json:"messages"`
+
+	eventHandlers   map[string]EventHandler
+	messageHandlers map[string]MessageHandler
+}
+
+// BindEvent binds an event handler to a token in the snapshot.
+func (s *Snapshot) BindEvent(token string, do EventHandler) {
+	if s.eventHandlers == nil {
+		s.eventHandlers = make(map[string]EventHandler)
+	}
+	s.eventHandlers[token] = do
+}
+
+// BindMessage binds a message handler to a token in the snapshot.
+func (s *Snapshot) BindMessage(token string, do MessageHandler) {
+	if s.messageHandlers == nil {
+		s.messageHandlers = make(map[string]MessageHandler)
+	}
+	s.messageHandlers[token] = do
+}
+
+// SubscriptionSnapshot captures the client's current event and message subscriptions, including
+// those added through families.
+func (c *Client) SubscriptionSnapshot() Snapshot {
+	s := Snapshot{
+		Events:   make(map[string][]string),
+		Messages: make(map[string][]string),
+	}
+	c.Events.subscriptionsMu.RLock()
+	for kind, handlers := range c.Events.subscriptions {
+		for token, do := range handlers {
+			s.Events[kind] = append(s.Events[kind], token)
+			s.BindEvent(token, do)
+		}
+	}
+	c.Events.subscriptionsMu.RUnlock()
+	c.Messages.subscriptionsMu.RLock()
+	for kind, handlers := range c.Messages.subscriptions {
+		for token, do := range handlers {
+			s.Messages[kind] = append(s.Messages[kind], token)
+			s.BindMessage(token, do)
+		}
+	}
+	c.Messages.subscriptionsMu.RUnlock()
+
+	return s
+}
+
+// RestoreSubscriptions subscribes the client to every kind in the snapshot with the handlers bound
+// to its tokens.  Tokens without a bound handler are skipped with a warning.
+func (c *Client) RestoreSubscriptions(s Snapshot) {
+	for kind, tokens := range s.Events {
+		for _, token := range tokens {
+			do, ok := s.eventHandlers[token]
+			if !ok {
+				warn(fmt.Errorf("No handler bound to token '%s' for event '%s'.", token, kind))
+				continue
+			}
+			if err := c.Events.subscribe(kind, token, do); err != nil {
+				warn(err)
+			}
+		}
+	}
+	for kind, tokens := range s.Messages {
+		for _, token := range tokens {
+			do, ok := s.messageHandlers[token]
+			if !ok {
+				warn(fmt.Errorf("No handler bound to token '%s' for message '%s'.", token, kind))
+				continue
+			}
+			if err := c.Messages.subscribe(kind, token, do); err != nil {
+				warn(err)
+			}
+		}
+	}
+}
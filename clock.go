@@ -0,0 +1,52 @@
+package artemis
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the source of time for pings, activity tracking and message deadlines.  See
+// SetClockForTesting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clockBox lets clock hold any Clock, since atomic.Value requires a consistent concrete type.
+type clockBox struct {
+	Clock
+}
+
+var clock atomic.Value
+
+func init() {
+	clock.Store(clockBox{realClock{}})
+}
+
+// SetClockForTesting replaces the clock used for pings, activity tracking and message deadlines,
+// so that tests can advance time rather than sleep.  Connection read and write deadlines always
+// use the real time.  Pass nil to restore the real clock.
+func SetClockForTesting(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clock.Store(clockBox{c})
+}
+
+func now() time.Time {
+	return clock.Load().(clockBox).Now()
+}
+
+func after(d time.Duration) <-chan time.Time {
+	return clock.Load().(clockBox).After(d)
+}
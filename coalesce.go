@@ -0,0 +1,63 @@
+package artemis
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescer holds back broadcasts of coalesced kinds, so that each subscriber receives only the
+// latest event of a kind fired within the window.
+type coalescer struct {
+	mu      sync.Mutex
+	windows map[string]time.Duration
+	pending map[coalesceKey]*Event
+}
+
+type coalesceKey struct {
+	sub  chan *Event
+	kind string
+}
+
+// CoalesceBroadcasts holds back broadcasts of kind for window, per subscriber.  If more events of
+// kind are broadcast to a subscriber while one is held, only the latest is delivered when the
+// window ends.  A window of 0 or less stops coalescing kind.
+func (h *Hub) CoalesceBroadcasts(kind string, window time.Duration) {
+	h.coalescer.mu.Lock()
+	defer h.coalescer.mu.Unlock()
+	if window <= 0 {
+		delete(h.coalescer.windows, kind)
+		return
+	}
+	if h.coalescer.windows == nil {
+		h.coalescer.windows = make(map[string]time.Duration)
+		h.coalescer.pending = make(map[coalesceKey]*Event)
+	}
+	h.coalescer.windows[kind] = window
+}
+
+// coalesce holds e for sub if its kind is coalesced, and reports whether it did.
+func (h *Hub) coalesce(sub chan *Event, e *Event) bool {
+	h.coalescer.mu.Lock()
+	defer h.coalescer.mu.Unlock()
+	window, ok := h.coalescer.windows[e.Kind]
+	if !ok {
+		return false
+	}
+	key := coalesceKey{sub, e.Kind}
+	if replaced, ok := h.coalescer.pending[key]; ok {
+		// the replaced event will never be handled
+		replaced.handlerDone()
+		h.coalescer.pending[key] = e
+		return true
+	}
+	h.coalescer.pending[key] = e
+	time.AfterFunc(window, func() {
+		h.coalescer.mu.Lock()
+		latest := h.coalescer.pending[key]
+		delete(h.coalescer.pending, key)
+		h.coalescer.mu.Unlock()
+		h.send(sub, latest)
+	})
+
+	return true
+}
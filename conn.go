@@ -0,0 +1,31 @@
+package artemis
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is the WebSocket connection that a MessageAgent reads and writes messages on.  It is
+// satisfied by *websocket.Conn from gorilla/websocket, which the hub uses for the connections it
+// upgrades, and can be implemented to use another WebSocket library with Attach, or to fake a
+// connection in tests.  Message types, close codes and control frames are those of
+// gorilla/websocket.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	// NextWriter returns a writer for a message that is sent in fragments, see SendStream.
+	NextWriter(messageType int) (io.WriteCloser, error)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(appData string) error)
+	SetCloseHandler(h func(code int, text string) error)
+	// EnableWriteCompression may be a no-op for connections that don't support compression.
+	EnableWriteCompression(enable bool)
+	Close() error
+}
+
+var _ Conn = (*websocket.Conn)(nil)
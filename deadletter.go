@@ -0,0 +1,85 @@
+package artemis
+
+import (
+	"sync"
+	"time"
+)
+
+// maxDeadLetters is the number of undeliverable messages retained for DeadLetters.
+const maxDeadLetters = 256
+
+// DeadLetter is a message that SendToClientGlobal could not deliver, retained so that it can be
+// inspected with DeadLetters and replayed with RedeliverDeadLetter.
+type DeadLetter struct {
+	// ID identifies the dead letter among those retained.
+	ID          uint64
+	ClientID    string
+	Payload     []byte
+	MessageType int
+	Err         error
+	Time        time.Time
+}
+
+// deadLetterStore holds the most recent dead letters, oldest first.
+type deadLetterStore struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+	nextID  uint64
+}
+
+var deadLetters deadLetterStore
+
+func (s *deadLetterStore) add(clientID string, payload []byte, mtype int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.letters = append(s.letters, DeadLetter{s.nextID, clientID, payload, mtype, err, now()})
+	if len(s.letters) > maxDeadLetters {
+		s.letters = append([]DeadLetter(nil), s.letters[len(s.letters)-maxDeadLetters:]...)
+	}
+}
+
+func (s *deadLetterStore) remove(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, dl := range s.letters {
+		if dl.ID == id {
+			s.letters = append(s.letters[:i], s.letters[i+1:]...)
+			return
+		}
+	}
+}
+
+// DeadLetters returns up to limit of the most recent messages that SendToClientGlobal could not
+// deliver, newest first.  Up to 256 are retained, and the oldest are discarded to make room.
+func DeadLetters(limit int) []DeadLetter {
+	deadLetters.mu.Lock()
+	defer deadLetters.mu.Unlock()
+	if limit > len(deadLetters.letters) {
+		limit = len(deadLetters.letters)
+	}
+	if limit <= 0 {
+		return nil
+	}
+	recent := make([]DeadLetter, limit)
+	for i := range recent {
+		recent[i] = deadLetters.letters[len(deadLetters.letters)-1-i]
+	}
+
+	return recent
+}
+
+// RedeliverDeadLetter sends a dead letter's message to its client again, if the client is
+// connected, and stops retaining the dead letter once it has been sent.  It returns
+// ErrClientNotFound if the client is still not connected, or the error from sending the message.
+func RedeliverDeadLetter(dl DeadLetter) error {
+	c, _, ok := Locate(dl.ClientID)
+	if !ok {
+		return ErrClientNotFound
+	}
+	if err := c.Messages.TryPushMessage(dl.Payload, dl.MessageType); err != nil {
+		return err
+	}
+	deadLetters.remove(dl.ID)
+	return nil
+}
@@ -0,0 +1,78 @@
+package artemis
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers the idempotency keys of recently received messages, evicting the least
+// recently seen once it holds size keys, and keys older than window.
+type dedupCache struct {
+	window time.Duration
+	size   int
+
+	mu   sync.Mutex
+	lru  *list.List
+	keys map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupCache(window time.Duration, size int) *dedupCache {
+	dc := &dedupCache{}
+	dc.window = window
+	dc.size = size
+	dc.lru = list.New()
+	dc.keys = make(map[string]*list.Element)
+
+	return dc
+}
+
+// duplicate records key, and reports whether it was already seen within the window.
+func (dc *dedupCache) duplicate(key string) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	t := now()
+	if el, ok := dc.keys[key]; ok {
+		entry := el.Value.(*dedupEntry)
+		if dc.window <= 0 || t.Sub(entry.seen) < dc.window {
+			dc.lru.MoveToBack(el)
+			return true
+		}
+		dc.lru.Remove(el)
+		delete(dc.keys, key)
+	}
+	dc.keys[key] = dc.lru.PushBack(&dedupEntry{key, t})
+	for dc.lru.Len() > dc.size {
+		oldest := dc.lru.Front()
+		dc.lru.Remove(oldest)
+		delete(dc.keys, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
+
+// SetDeduplication makes the agent drop messages whose idempotency key (see
+// ParsedMessage.IdempotencyKey) matches one of the last size keys it received within window,
+// before they reach handlers.  A window of 0 remembers keys until they are evicted.  A size of 0
+// or less stops deduplication.  It should be set before the agent starts receiving messages.
+func (agent *MessageAgent) SetDeduplication(window time.Duration, size int) {
+	if size <= 0 {
+		agent.dedup = nil
+		return
+	}
+	agent.dedup = newDedupCache(window, size)
+}
+
+// duplicate reports whether p repeats a message that was received recently, warning if it does.
+func (agent *MessageAgent) duplicate(p *ParsedMessage) bool {
+	if agent.dedup == nil || p.IdempotencyKey == "" || !agent.dedup.duplicate(p.IdempotencyKey) {
+		return false
+	}
+	warn(fmt.Errorf("Dropping duplicate message '%s' with idempotency key '%s'.", p.Kind, p.IdempotencyKey))
+	return true
+}
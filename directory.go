@@ -0,0 +1,95 @@
+package artemis
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// directory maps the ID of every connected client, in any hub, to the clients with that ID and
+	// their hubs.  Clients change their entry with SetID.
+	directory   = make(map[string]map[*Client]*Hub)
+	directoryMu sync.RWMutex
+
+	// ErrClientNotFound indicates that no connected client has the requested ID.
+	ErrClientNotFound = errors.New("No connected client with that ID exists in any hub.")
+)
+
+// Locate finds a connected client by ID in any hub.  If more than one client has the ID, any one
+// of them may be returned.
+func Locate(clientID string) (*Client, *Hub, bool) {
+	directoryMu.RLock()
+	defer directoryMu.RUnlock()
+	for c, h := range directory[clientID] {
+		return c, h, true
+	}
+
+	return nil, nil, false
+}
+
+// SendToClientGlobal sends a message to the connected client with the given ID, whichever hub it
+// is in.  Messages that can't be sent are kept as dead letters, see DeadLetters.
+func SendToClientGlobal(id string, payload []byte, mtype int) error {
+	c, _, ok := Locate(id)
+	if !ok {
+		deadLetters.add(id, payload, mtype, ErrClientNotFound)
+		return ErrClientNotFound
+	}
+	if err := c.Messages.TryPushMessage(payload, mtype); err != nil {
+		if err != ErrBadMessageType {
+			deadLetters.add(id, payload, mtype, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func addToDirectory(c *Client, h *Hub) {
+	directoryMu.Lock()
+	defer directoryMu.Unlock()
+	addToDirectoryLocked(c.GetID(), c, h)
+}
+
+func removeFromDirectory(c *Client) {
+	directoryMu.Lock()
+	defer directoryMu.Unlock()
+	removeFromDirectoryLocked(c.GetID(), c)
+}
+
+// addToDirectoryLocked must be called with directoryMu held.
+func addToDirectoryLocked(id string, c *Client, h *Hub) {
+	clients, ok := directory[id]
+	if !ok {
+		clients = make(map[*Client]*Hub)
+		directory[id] = clients
+	}
+	clients[c] = h
+}
+
+// removeFromDirectoryLocked removes c from the entry for id, and returns the hub it was listed in,
+// if it was.  It must be called with directoryMu held.
+func removeFromDirectoryLocked(id string, c *Client) (*Hub, bool) {
+	clients := directory[id]
+	h, ok := clients[c]
+	if !ok {
+		return nil, false
+	}
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(directory, id)
+	}
+	return h, true
+}
+
+// renameInDirectory changes the ID of c and moves its directory entry, if it has one, so that
+// lookups by either ID never see it under the wrong one.
+func renameInDirectory(c *Client, id string) {
+	directoryMu.Lock()
+	defer directoryMu.Unlock()
+	h, listed := removeFromDirectoryLocked(c.GetID(), c)
+	c.id.Store(id)
+	c.ID = id
+	if listed {
+		addToDirectoryLocked(id, c, h)
+	}
+}
@@ -0,0 +1,42 @@
+package artemis
+
+// OnDisconnect adds a callback that runs once the agent's connection is lost, whether it was
+// closed normally or failed.  reason is the *websocket.CloseError with the close code if a close
+// frame ended the connection, ErrMissedPong if the client stopped answering pings, or else the
+// read or write error that ended it.  Callbacks added after the connection was lost run
+// immediately.  Detaching the connection does not count as losing it.
+func (agent *MessageAgent) OnDisconnect(do func(reason error)) {
+	agent.disconnectMu.Lock()
+	if !agent.disconnected {
+		agent.onDisconnect = append(agent.onDisconnect, do)
+		agent.disconnectMu.Unlock()
+		return
+	}
+	reason := agent.disconnectReason
+	agent.disconnectMu.Unlock()
+	do(reason)
+}
+
+// recordDisconnect keeps the first reason given for losing the connection.
+func (agent *MessageAgent) recordDisconnect(reason error) {
+	agent.disconnectMu.Lock()
+	defer agent.disconnectMu.Unlock()
+	if agent.disconnectReason == nil && !agent.disconnected {
+		agent.disconnectReason = reason
+	}
+}
+
+// runDisconnectCallbacks runs the OnDisconnect callbacks.  It is called once, by cleanup.
+func (agent *MessageAgent) runDisconnectCallbacks() {
+	agent.disconnectMu.Lock()
+	agent.disconnected = true
+	if agent.disconnectReason == nil {
+		agent.disconnectReason = ErrMessageConnectionLost
+	}
+	reason, callbacks := agent.disconnectReason, agent.onDisconnect
+	agent.onDisconnect = nil
+	agent.disconnectMu.Unlock()
+	for _, do := range callbacks {
+		do(reason)
+	}
+}
@@ -0,0 +1,79 @@
+package artemis
+
+import (
+	"sync"
+	"time"
+)
+
+// TimedError is an error or warning retained by the error history, with the time it was reported.
+type TimedError struct {
+	Err     error
+	Time    time.Time
+	Warning bool
+}
+
+func (te TimedError) Error() string {
+	return te.Err.Error()
+}
+
+// errorHistory is a ring buffer of the most recently reported errors and warnings.
+type errorHistory struct {
+	mu      sync.Mutex
+	entries []TimedError
+	next    int
+	full    bool
+}
+
+var history errorHistory
+
+// EnableErrorHistory retains the last size errors and warnings, for inspection with RecentErrors.
+// Errors are still sent to Errors and Warnings as usual.  A size of 0 or less disables the history
+// and discards anything retained.
+func EnableErrorHistory(size int) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	history.entries = nil
+	history.next = 0
+	history.full = false
+	if size > 0 {
+		history.entries = make([]TimedError, size)
+	}
+}
+
+// RecentErrors returns up to n of the most recent errors and warnings, newest first.  It returns
+// nothing unless EnableErrorHistory has been called.
+func RecentErrors(n int) []TimedError {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	size := history.next
+	if history.full {
+		size = len(history.entries)
+	}
+	if n > size {
+		n = size
+	}
+	if n <= 0 {
+		return nil
+	}
+	recent := make([]TimedError, n)
+	for i := range recent {
+		idx := (history.next - 1 - i + len(history.entries)) % len(history.entries)
+		recent[i] = history.entries[idx]
+	}
+
+	return recent
+}
+
+func recordError(e error, warning bool) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	if len(history.entries) == 0 {
+		return
+	}
+	history.entries[history.next] = TimedError{e, time.Now(), warning}
+	history.next++
+	if history.next == len(history.entries) {
+		history.next = 0
+		history.full = true
+	}
+}
@@ -1,18 +1,43 @@
 package artemis
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
 
 type Event struct {
 	Kind      string
 	Data      interface{}
 	Recipient interface{}
 	Source    interface{}
+	// HubSeq increases with every event fired in the hub, so that gaps reveal dropped events.
+	HubSeq uint64
+	// Attempt is 1 for the first delivery of the event to a subscriber, and counts up with each
+	// redelivery.  See Hub.SetRedelivery.
+	Attempt int
+
+	// nacked is set if a handler failed to process the event, see Nack
+	nacked int32
+
+	// acks tracks outstanding handlers for events fired with BroadcastAck, nil otherwise.
+	acks *sync.WaitGroup
+
+	// ctx is the context of the handler that the event was passed to, and origin is the event it
+	// was copied from for that handler, which holds the nacked state.
+	ctx    context.Context
+	origin *Event
+	// slot is the place held by the handler that the event was passed to, or nil if the handler
+	// was delivered inline, see SetHandlerConcurrency
+	slot *handlerSlot
 }
 
 func newEvent(kind string, data DataGetter) *Event {
 	e := &Event{}
 
 	e.Kind = kind
+	e.Attempt = 1
 	if data != nil {
 		e.Data = data.Data()
 	} else {
@@ -22,6 +47,86 @@ func newEvent(kind string, data DataGetter) *Event {
 	return e
 }
 
+// Context returns a context that is done when the handler that the event was passed to is
+// cancelled with Hub.CancelInFlight, or has returned.
+func (e *Event) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// Nack signals that a handler failed to process the event.  If the hub redelivers events, the
+// event is delivered to the subscriber again once its handlers have finished.
+func (e *Event) Nack() {
+	atomic.StoreInt32(&e.root().nacked, 1)
+}
+
+// Ack signals that the event was processed, cancelling an earlier Nack.  Events are acknowledged
+// by default, so Ack is only needed after Nack.
+func (e *Event) Ack() {
+	atomic.StoreInt32(&e.root().nacked, 0)
+}
+
+func (e *Event) isNacked() bool {
+	return atomic.LoadInt32(&e.root().nacked) == 1
+}
+
+func (e *Event) root() *Event {
+	if e.origin != nil {
+		return e.origin
+	}
+	return e
+}
+
+// withContext returns a copy of e for a single handler, carrying the handler's context.
+func (e *Event) withContext(ctx context.Context) *Event {
+	view := &Event{}
+	view.Kind = e.Kind
+	view.Data = e.Data
+	view.Recipient = e.Recipient
+	view.Source = e.Source
+	view.HubSeq = e.HubSeq
+	view.Attempt = e.Attempt
+	view.acks = e.acks
+	view.ctx = ctx
+	view.origin = e.root()
+
+	return view
+}
+
+// runHandler runs do for the event as one of the hub's handlers, with a context of its own, once
+// there is a slot for it.
+func (e *Event) runHandler(h *Hub, do EventHandler) {
+	slot := h.acquireHandlerSlot()
+	defer slot.release()
+	e.runHandlerInSlot(h, do, slot)
+}
+
+// runHandlerInSlot is like runHandler, but the handler runs in a slot that is already held, or
+// without one if slot is nil.
+func (e *Event) runHandlerInSlot(h *Hub, do EventHandler, slot *handlerSlot) {
+	h.execHandler(e.Kind, e.Recipient, context.Background(), func(ctx context.Context) {
+		view := e.withContext(ctx)
+		view.slot = slot
+		do(view)
+	})
+}
+
+// expectHandlers records that n more handlers must complete before an acknowledged event is done.
+func (e *Event) expectHandlers(n int) {
+	if e.acks != nil {
+		e.acks.Add(n)
+	}
+}
+
+// handlerDone records the completion of a single handler for an acknowledged event.
+func (e *Event) handlerDone() {
+	if e.acks != nil {
+		e.acks.Done()
+	}
+}
+
 type DataGetter interface {
 	Data() interface{}
 }
@@ -37,6 +142,19 @@ func (ed *EventData) Data() interface{} {
 // EventHandler is a function that handles events.
 type EventHandler func(*Event)
 
+// ConcurrencyPolicy determines whether a handler may run alongside itself.  See
+// EventAgent.SubscribeWithPolicy.
+type ConcurrencyPolicy int
+
+const (
+	// Serial runs the handler for one event of its kind at a time, in the order events arrive.
+	// This is how handlers added with Subscribe run.
+	Serial ConcurrencyPolicy = iota
+	// Concurrent runs the handler for each event on its own goroutine, so that runs for the same
+	// kind may overlap.
+	Concurrent
+)
+
 type EventHandlerSet map[string]EventHandler
 
 // EventResponderSet is predicated on being able to distinguish between functions to prevent
@@ -50,12 +168,17 @@ func getEventHandlerKey(eh EventHandler) string {
 }
 
 func (ehs EventHandlerSet) Add(h EventHandler) {
-	key := getEventHandlerKey(h)
+	if err := ehs.add(getEventHandlerKey(h), h); err != nil {
+		warn(err)
+	}
+}
+
+func (ehs EventHandlerSet) add(key string, h EventHandler) error {
 	if _, ok := ehs[key]; ok {
-		warn(ErrDuplicateHandler)
-		return
+		return ErrDuplicateHandler
 	}
 	ehs[key] = h
+	return nil
 }
 
 func (ehs EventHandlerSet) Remove(h EventHandler) {
@@ -68,11 +191,84 @@ type EventAgent struct {
 	Hub *Hub
 
 	// Delegate will become the recipient on Event objects received if set.
-	Delegate interface{}
+	//
+	// Deprecated: assigning Delegate while events are being delivered is a data race.  Use
+	// SetDelegate and GetDelegate, which guard it with delegateMu.
+	Delegate   interface{}
+	delegateMu sync.RWMutex
 
-	events        chan *Event
-	ready         bool
-	subscriptions map[string]EventHandlerSet
+	events chan *Event
+	// subscriptionsMu guards ready, subscriptions and queues, which are read while delivering
+	// events and may be changed from any goroutine.  It is never held while handlers run.
+	subscriptionsMu sync.RWMutex
+	ready           bool
+	subscriptions   map[string]EventHandlerSet
+	queues          map[string]*eventQueue
+	// dispatch defers unsubscribing while handlers are being run
+	dispatch dispatchGuard
+}
+
+// eventQueue runs a single handler on its own goroutine, so that a slow handler does not hold up
+// delivery to the rest of the agent's subscriptions.  Events that arrive while the queue is full
+// are dropped.
+type eventQueue struct {
+	hub     *Hub
+	kind    string
+	do      EventHandler
+	events  chan *Event
+	dropped uint64
+	// closed is set under mu when the handler is unsubscribed, after which pushes are ignored
+	mu     sync.Mutex
+	closed bool
+}
+
+func newEventQueue(hub *Hub, kind string, size int, do EventHandler) *eventQueue {
+	q := &eventQueue{}
+	q.hub = hub
+	q.kind = kind
+	q.do = do
+	q.events = make(chan *Event, size)
+	go q.run()
+
+	return q
+}
+
+func (q *eventQueue) run() {
+	for ev := range q.events {
+		ev.runHandler(q.hub, q.do)
+		ev.handlerDone()
+	}
+}
+
+func (q *eventQueue) push(ev *Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		// unsubscribed while the event was being delivered
+		return
+	}
+	// the queued handler must finish before an acknowledged event is done, not just the push
+	ev.expectHandlers(1)
+	select {
+	case q.events <- ev:
+	default:
+		ev.handlerDone()
+		atomic.AddUint64(&q.dropped, 1)
+		warn(fmt.Errorf("Buffered handler for event '%s' is full, dropping event.", q.kind))
+	}
+}
+
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+}
+
+func getEventQueueKey(kind string, do EventHandler) string {
+	return kind + ":" + getEventHandlerKey(do)
 }
 
 func NewEventAgent() *EventAgent {
@@ -83,44 +279,379 @@ func (agent *EventAgent) EventAgent() *EventAgent {
 	return agent
 }
 
+// GetDelegate returns the object that receives events in place of the agent, or nil.
+func (agent *EventAgent) GetDelegate() interface{} {
+	agent.delegateMu.RLock()
+	defer agent.delegateMu.RUnlock()
+	return agent.Delegate
+}
+
+// SetDelegate sets an object to become the Recipient of events received by the agent.  It is
+// safe to call at any time, and takes effect for events delivered after it returns.
+func (agent *EventAgent) SetDelegate(delegate interface{}) {
+	agent.delegateMu.Lock()
+	defer agent.delegateMu.Unlock()
+	agent.Delegate = delegate
+}
+
+// Subscribe adds a handler for events of kind.  Errors, such as ErrNoHub for an agent that was
+// not created by a hub, are reported as warnings.
 func (agent *EventAgent) Subscribe(kind string, do EventHandler) {
+	if err := agent.subscribe(kind, getEventHandlerKey(do), do); err != nil {
+		warn(err)
+	}
+}
+
+// SubscribeMany subscribes each handler to its kind.  Kinds that could not be subscribed are
+// reported together in the returned SubscribeErrors.
+func (agent *EventAgent) SubscribeMany(handlers map[string]EventHandler) error {
+	errs := make(SubscribeErrors)
+	for kind, do := range handlers {
+		if err := agent.subscribe(kind, getEventHandlerKey(do), do); err != nil {
+			errs[kind] = err
+		}
+	}
+
+	return errs.orNil()
+}
+
+// SubscribeTransformed is like Subscribe, but the handler receives a copy of each event with its
+// Data replaced by transform(Data).  Other handlers and subscribers are not affected, as long as
+// transform returns a new value rather than modifying the one it is given.
+func (agent *EventAgent) SubscribeTransformed(kind string, transform func(interface{}) interface{}, do EventHandler) {
+	transformed := func(e *Event) {
+		view := *e
+		view.Data = transform(e.Data)
+		do(&view)
+	}
+	if err := agent.subscribe(kind, getEventHandlerKey(do), transformed); err != nil {
+		warn(err)
+	}
+}
+
+// SubscribeBuffered is like Subscribe, but runs the handler on its own goroutine with a queue of
+// bufSize events, so that a slow handler doesn't delay the agent's other handlers.  Events that
+// arrive when the queue is full are dropped and counted - see DroppedEvents.
+func (agent *EventAgent) SubscribeBuffered(kind string, bufSize int, do EventHandler) {
+	if agent.Hub == nil {
+		warn(ErrNoHub)
+		return
+	}
+	key := getEventQueueKey(kind, do)
+	agent.subscriptionsMu.Lock()
+	if _, ok := agent.queues[key]; ok {
+		agent.subscriptionsMu.Unlock()
+		warn(ErrDuplicateHandler)
+		return
+	}
+	q := newEventQueue(agent.Hub, kind, bufSize, do)
+	agent.queues[key] = q
+	agent.subscriptionsMu.Unlock()
+	if err := agent.subscribe(kind, getEventHandlerKey(do), q.push); err != nil {
+		agent.subscriptionsMu.Lock()
+		delete(agent.queues, key)
+		agent.subscriptionsMu.Unlock()
+		q.close()
+		warn(err)
+	}
+}
+
+// SubscribeWithPolicy is like Subscribe, but policy determines whether the handler may handle
+// several events of kind at once.  Concurrent handlers should be safe to run in parallel, and
+// their events are not redelivered when nacked.
+func (agent *EventAgent) SubscribeWithPolicy(kind string, policy ConcurrencyPolicy, do EventHandler) {
+	handler := do
+	if policy == Concurrent {
+		handler = func(e *Event) {
+			if e.slot == nil {
+				// delivered inline, so run on the goroutine that broadcast the event
+				do(e)
+				return
+			}
+			// take over the launcher's slot, or wait for another, before starting a goroutine so
+			// that a burst of events can't start more of them than SetHandlerConcurrency allows
+			slot := e.slot.transfer()
+			if slot == nil {
+				slot = agent.Hub.acquireHandlerSlot()
+			}
+			// the handler must finish before an acknowledged event is done, not just its launch
+			e.expectHandlers(1)
+			go func() {
+				defer slot.release()
+				e.runHandlerInSlot(agent.Hub, do, slot)
+				e.handlerDone()
+			}()
+		}
+	}
+	if err := agent.subscribe(kind, getEventHandlerKey(do), handler); err != nil {
+		warn(err)
+	}
+}
+
+// DroppedEvents returns the number of events of kind that were dropped by buffered handlers
+// because their queues were full.
+func (agent *EventAgent) DroppedEvents(kind string) uint64 {
+	agent.subscriptionsMu.RLock()
+	defer agent.subscriptionsMu.RUnlock()
+	var dropped uint64
+	for _, q := range agent.queues {
+		if q.kind == kind {
+			dropped += atomic.LoadUint64(&q.dropped)
+		}
+	}
+
+	return dropped
+}
+
+// DroppedSeqs returns the HubSeq of recent events that were dropped because the agent was not
+// keeping up with its hub.
+func (agent *EventAgent) DroppedSeqs() []uint64 {
+	return agent.Hub.droppedFor(agent.events)
+}
+
+func (agent *EventAgent) subscribe(kind, key string, do EventHandler) error {
+	if agent.Hub == nil {
+		return ErrNoHub
+	}
+	agent.subscriptionsMu.Lock()
 	if !agent.ready {
+		agent.ready = true
 		go agent.listen()
 	}
 	if _, ok := agent.subscriptions[kind]; !ok {
 		agent.subscriptions[kind] = make(EventHandlerSet)
 	}
-	agent.subscriptions[kind].Add(do)
-	agent.Hub.subscribe(kind, agent.events)
+	err := agent.subscriptions[kind].add(key, do)
+	agent.subscriptionsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := agent.Hub.subscribe(kind, agent); err != nil {
+		agent.unsubscribe(kind, key)
+		return err
+	}
+	return nil
+}
+
+// handlers returns a snapshot of the handlers for kind, and whether the agent has subscribed to
+// kind.
+func (agent *EventAgent) handlers(kind string) ([]EventHandler, bool) {
+	agent.subscriptionsMu.RLock()
+	defer agent.subscriptionsMu.RUnlock()
+	set, ok := agent.subscriptions[kind]
+	handlers := make([]EventHandler, 0, len(set))
+	for _, do := range set {
+		handlers = append(handlers, do)
+	}
+	return handlers, ok
 }
 
+// Unsubscribe removes a handler for kind.  If it is called while the agent is running handlers
+// for kind, e.g. by a handler unsubscribing itself, the removal takes effect once they have all
+// run.  Handlers for other kinds don't delay it.
 func (agent *EventAgent) Unsubscribe(kind string, do EventHandler) {
-	if actions, ok := agent.subscriptions[kind]; ok {
-		actions.Remove(do)
+	agent.UnsubscribeKeyed(kind, getEventHandlerKey(do))
+}
+
+// SubscribeKeyed is like Subscribe, but the handler is identified by key rather than by the
+// function, so that handlers made by the same code, such as closures, can be told apart and
+// removed reliably with UnsubscribeKeyed.  It returns ErrDuplicateHandler if key is in use.
+func (agent *EventAgent) SubscribeKeyed(kind, key string, do EventHandler) error {
+	return agent.subscribe(kind, key, do)
+}
+
+// UnsubscribeKeyed removes the handler for kind that was subscribed with key.  Like Unsubscribe,
+// the removal waits for any handlers for kind that are running.
+func (agent *EventAgent) UnsubscribeKeyed(kind, key string) {
+	if agent.Hub == nil {
+		warn(ErrNoHub)
+		return
+	}
+	if agent.dispatch.deferChange(kind, func() { agent.unsubscribe(kind, key) }) {
+		return
+	}
+	agent.unsubscribe(kind, key)
+}
+
+func (agent *EventAgent) unsubscribe(kind, key string) {
+	agent.subscriptionsMu.Lock()
+	actions, ok := agent.subscriptions[kind]
+	if ok {
+		delete(actions, key)
+	}
+	queueKey := kind + ":" + key
+	if q, ok := agent.queues[queueKey]; ok {
+		q.close()
+		delete(agent.queues, queueKey)
+	}
+	// the hub keeps sending this kind until the last handler for it is gone
+	last := len(actions) == 0
+	if last {
+		delete(agent.subscriptions, kind)
+	}
+	agent.subscriptionsMu.Unlock()
+	if last {
+		agent.Hub.unsubscribe(kind, agent.events)
 	}
-	agent.Hub.unsubscribe(kind, agent.events)
 }
 
+// unsubscribeAll removes all of the agent's handlers, like unsubscribe does for each of them.
+func (agent *EventAgent) unsubscribeAll() {
+	agent.subscriptionsMu.Lock()
+	for key, q := range agent.queues {
+		q.close()
+		delete(agent.queues, key)
+	}
+	agent.subscriptions = make(map[string]EventHandlerSet)
+	agent.subscriptionsMu.Unlock()
+	agent.Hub.unsubscribeAll(agent.events)
+}
+
+// deliver sends an event directly to each agent that subscribes to kind, bypassing the hub's
+// subscriptions.
+func deliver(h *Hub, agents map[*EventAgent]struct{}, kind string, data DataGetter, source interface{}) {
+	seq := h.nextEventSeq()
+	for agent := range agents {
+		if handlers, _ := agent.handlers(kind); len(handlers) == 0 {
+			continue
+		}
+		e := newEvent(kind, data)
+		e.Source = source
+		e.HubSeq = seq
+		h.send(agent.events, e)
+	}
+}
+
+// listen sorts the events sent to the agent by kind, so that each kind is handled in order, but
+// independently of the others.
 func (agent *EventAgent) listen() {
 	// TODO tj test that this is cleaned up when garbage is collected
 	defer close(agent.events)
-	agent.ready = true
+	kinds := &kindQueues{queues: make(map[string]*kindQueue)}
 	for {
 		ev, ok := <-agent.events
 		if !ok {
 			break
 		}
-		if agent.Delegate != nil {
-			ev.Recipient = agent.Delegate
-		} else {
-			ev.Recipient = agent
+		if !kinds.push(ev, cap(agent.events), agent.handleQueued) {
+			agent.Hub.drop(agent.events, ev)
 		}
-		if actions, ok := agent.subscriptions[ev.Kind]; ok {
-			for _, do := range actions {
-				do(ev)
+	}
+
+	warn(ErrEventChannelHasClosed)
+}
+
+// kindQueues holds an agent's queue for each kind that has events waiting to be handled.  A queue
+// is removed once it is idle, so that kinds seen once are not kept.
+type kindQueues struct {
+	mu     sync.Mutex
+	queues map[string]*kindQueue
+}
+
+// push queues ev behind the other events of its kind, see kindQueue.push.
+func (k *kindQueues) push(ev *Event, limit int, handle func(*Event)) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	q, ok := k.queues[ev.Kind]
+	if !ok {
+		q = &kindQueue{kind: ev.Kind, owner: k}
+		k.queues[ev.Kind] = q
+	}
+	return q.push(ev, limit, handle)
+}
+
+// kindQueue holds the events of one kind that are waiting to be handled by an agent, so that a
+// slow handler of one kind does not hold up the agent's handlers of other kinds.  Its goroutine
+// only runs while there are events waiting.
+type kindQueue struct {
+	kind    string
+	owner   *kindQueues
+	mu      sync.Mutex
+	pending []*Event
+	running bool
+}
+
+// push queues ev to be handled, unless limit events are already waiting, and reports whether it
+// did.
+func (q *kindQueue) push(ev *Event, limit int, handle func(*Event)) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= limit {
+		return false
+	}
+	q.pending = append(q.pending, ev)
+	if !q.running {
+		q.running = true
+		go q.run(handle)
+	}
+	return true
+}
+
+func (q *kindQueue) run(handle func(*Event)) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			if q.retire() {
+				return
 			}
+			continue
 		}
+		ev := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		handle(ev)
 	}
+}
 
-	warn(ErrEventChannelHasClosed)
+// retire removes the queue from its owner if no events have arrived for it, and reports whether
+// it did.  The owner's lock is taken first, as push does, so that an event can't be queued on a
+// queue that has been removed.
+func (q *kindQueue) retire() bool {
+	q.owner.mu.Lock()
+	defer q.owner.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) > 0 {
+		return false
+	}
+	q.running = false
+	delete(q.owner.queues, q.kind)
+	return true
+}
+
+// handleQueued runs the agent's handlers for an event that was sent over its channel.
+func (agent *EventAgent) handleQueued(ev *Event) {
+	agent.handleEvent(ev, false)
+}
+
+// handleEvent runs the agent's handlers for ev.  Handlers delivered inline, on the goroutine that
+// broadcast the event, don't wait for a slot; that goroutine may be a handler that holds one.
+func (agent *EventAgent) handleEvent(ev *Event, inline bool) {
+	if delegate := agent.GetDelegate(); delegate != nil {
+		ev.Recipient = delegate
+	} else {
+		ev.Recipient = agent
+	}
+	// changes to the subscriptions wait until the handlers in the snapshot have run
+	agent.dispatch.begin(ev.Kind)
+	actions, ok := agent.handlers(ev.Kind)
+	if ok && agent.Hub.allowDispatch(ev.Kind) {
+		ev.expectHandlers(len(actions))
+		for _, do := range actions {
+			if inline {
+				ev.runHandlerInSlot(agent.Hub, do, nil)
+			} else {
+				ev.runHandler(agent.Hub, do)
+			}
+			ev.handlerDone()
+		}
+	}
+	agent.dispatch.end(ev.Kind)
+	if ok && ev.isNacked() {
+		agent.Hub.redeliver(agent.events, ev)
+	}
+	// delivery to this agent is complete
+	ev.handlerDone()
 }
@@ -0,0 +1,74 @@
+package artemis
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BatchKind is the kind of the frames in which SendEvent combines the events of an agent with
+// broadcast batching.  The frame's data is an array of messages, each with the same shape as a
+// message sent by SendEvent, in the order they were sent:
+//
+//	{"kind": "batch", "data": [{"kind": "a", "data": 1}, {"kind": "b", "data": 2}]}
+//
+// Clients of agents with batching should unpack each batch and handle its messages in order.
+const BatchKind = "batch"
+
+// SetBroadcastBatching makes SendEvent hold the events it forwards to the client for up to
+// window, and send all of the events held in that time as a single frame of BatchKind.  An
+// event that is alone in its window is sent on its own, as usual.  A window of 0, the default,
+// sends each event immediately.
+func (agent *MessageAgent) SetBroadcastBatching(window time.Duration) {
+	agent.eventBatchMu.Lock()
+	agent.eventBatchWindow = window
+	agent.eventBatchMu.Unlock()
+	if window <= 0 {
+		agent.flushEventBatch()
+	}
+}
+
+// batchEvent adds m to the batch that is waiting to be sent, starting a window if there is none,
+// and reports whether batching is enabled.
+func (agent *MessageAgent) batchEvent(m []byte) bool {
+	agent.eventBatchMu.Lock()
+	defer agent.eventBatchMu.Unlock()
+	window := agent.eventBatchWindow
+	if window <= 0 {
+		return false
+	}
+	agent.eventBatch = append(agent.eventBatch, json.RawMessage(m))
+	if len(agent.eventBatch) == 1 {
+		flush := after(window)
+		go func() {
+			select {
+			case <-flush:
+				agent.flushEventBatch()
+			case <-agent.done:
+			}
+		}()
+	}
+	return true
+}
+
+// flushEventBatch sends the events that are waiting to be sent, if any.
+func (agent *MessageAgent) flushEventBatch() {
+	agent.eventBatchMu.Lock()
+	batch := agent.eventBatch
+	agent.eventBatch = nil
+	agent.eventBatchMu.Unlock()
+	switch len(batch) {
+	case 0:
+		return
+	case 1:
+		agent.PushMessage(batch[0], websocket.TextMessage)
+		return
+	}
+	m, err := MarshalJSONMessage(BatchKind, batch)
+	if err != nil {
+		agent.throw(err)
+		return
+	}
+	agent.PushMessage(m, websocket.TextMessage)
+}
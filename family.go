@@ -1,36 +1,489 @@
 package artemis
 
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// MemberLeftKind is the kind of the event that a family with NotifyOnLeave fires to its remaining
+// members when a member client disconnects.  The event's data is a MemberLeft.
+const MemberLeftKind = "member.left"
+
+// MemberLeft describes a client that disconnected from a family.
+type MemberLeft struct {
+	// ID is the departed client's ID.
+	ID string `json:"id"`
+	// Code is the close code, if a close frame ended the connection.
+	Code int `json:"code,omitempty"`
+	// Reason describes why the connection was lost, see MessageAgent.OnDisconnect.
+	Reason string `json:"reason"`
+}
+
+// DuplicatePolicy determines what Family.Add does with a delegate that is already a member.
+type DuplicatePolicy int
+
+const (
+	// DuplicateWarnIgnore ignores the duplicate and warns with ErrDuplicateDelegate.
+	DuplicateWarnIgnore DuplicatePolicy = iota
+	// DuplicateSilentIgnore ignores the duplicate, so that adding is idempotent.
+	DuplicateSilentIgnore
+	// DuplicateError ignores the duplicate and returns ErrDuplicateDelegate from Add.
+	DuplicateError
+)
+
 // Family is group of Agents and AgentDelegates (both Message and Event type).
 // Families can subscribe all of their members to handle messages and/or events.
 // The family is "dumb" - no handling happens here.
 type Family struct {
 	ID  string
 	Hub *Hub
+	// DuplicatePolicy is consulted when a member is added again.  Default is DuplicateWarnIgnore.
+	DuplicatePolicy DuplicatePolicy
+	// NotifyOnLeave fires a MemberLeftKind event to the remaining members when a member client
+	// disconnects.  Default is false.
+	NotifyOnLeave bool
 
 	Messages messageSubscriber
 	Events   eventSubscriber
+
+	mu      sync.Mutex
+	onJoin  func([]Delegate)
+	onLeave func(Delegate)
+	// lastValues holds the last message pushed for each kind enabled by EnableLastValue, or nil if
+	// none has been pushed yet.  lastValueOrder lists the kinds with values, oldest first.
+	lastValues     map[string]*frame
+	lastValueOrder []string
+	lastValueBytes int
+	maxValueBytes  int
+	maxValueCount  int
+
+	// paused holds back deliveries until Resume, up to maxPaused of them
+	paused     bool
+	pausedSend []func()
+	maxPaused  int
+	// resuming is set while Resume delivers the held deliveries, so that new ones queue behind
+	// them rather than overtake them
+	resuming bool
 }
 
-// NewFamily creates a new instance of Family and adds it to a hub.
+// NewFamily creates a new instance of Family and adds it to the default hub.  If a family with
+// that ID already exists, it is returned instead.
 func NewFamily(id string) *Family {
 	return DefaultHub().NewFamily(id)
 }
 
-func (f *Family) Add(d Delegate) {
-	f.Messages.Add(d)
-	f.Events.Add(d)
+// Add makes d a member of the family, subscribing it to the family's subscriptions.  If d is
+// already a member, the family's DuplicatePolicy decides whether an error is returned.  Add does
+// not enforce the hub's MaxFamiliesPerClient; use Client.Join for that.
+func (f *Family) Add(d Delegate) error {
+	messagesErr := f.Messages.add(d)
+	eventsErr := f.Events.add(d)
+	if messagesErr == nil {
+		f.replayLastValues(d)
+	}
+	if messagesErr == nil || eventsErr == nil {
+		f.joined([]Delegate{d})
+		return nil
+	}
+	return f.duplicate()
+}
+
+// AddAll is like Add for each of ds, but subscribes them all in a single pass over the family's
+// subscriptions, and runs the OnJoin callback once for all of them.  If any of ds is already a
+// member, the rest are still added and the family's DuplicatePolicy decides the error returned.
+// Like Add, it does not enforce the hub's MaxFamiliesPerClient; use Client.Join for that.
+func (f *Family) AddAll(ds ...Delegate) error {
+	messageDelegates := make([]MessageDelegate, len(ds))
+	eventDelegates := make([]EventDelegate, len(ds))
+	for i, d := range ds {
+		messageDelegates[i] = d
+		eventDelegates[i] = d
+	}
+	addedMessages := f.Messages.addAll(messageDelegates)
+	addedEvents := f.Events.addAll(eventDelegates)
+
+	var added []Delegate
+	duplicates := false
+	for i, d := range ds {
+		if addedMessages[i] {
+			f.replayLastValues(d)
+		}
+		if addedMessages[i] || addedEvents[i] {
+			added = append(added, d)
+		} else {
+			duplicates = true
+		}
+	}
+	if len(added) > 0 {
+		f.joined(added)
+	}
+	if duplicates {
+		return f.duplicate()
+	}
+	return nil
+}
+
+// duplicate applies the family's DuplicatePolicy to an attempt to add an existing member.
+func (f *Family) duplicate() error {
+	switch f.DuplicatePolicy {
+	case DuplicateSilentIgnore:
+		return nil
+	case DuplicateError:
+		return ErrDuplicateDelegate
+	default:
+		warn(ErrDuplicateDelegate)
+		return nil
+	}
+}
+
+// AddDelegate is Add with its original signature, for use where a func(Delegate) is needed.  Any
+// error is reported as a warning.
+func (f *Family) AddDelegate(d Delegate) {
+	if err := f.Add(d); err != nil {
+		warn(err)
+	}
+}
+
+// EnableLastValue makes the family remember the last message of kind that it pushes, and replay
+// it to members as they are added.  Only text messages that DefaultTextParser can parse are
+// remembered.
+func (f *Family) EnableLastValue(kind string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lastValues == nil {
+		f.lastValues = make(map[string]*frame)
+	}
+	if _, ok := f.lastValues[kind]; !ok {
+		f.lastValues[kind] = nil
+	}
+}
+
+// recordLastValue stores m if its kind is enabled for last value replay.
+func (f *Family) recordLastValue(m []byte, mtype int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.lastValues) == 0 || mtype != websocket.TextMessage {
+		return
+	}
+	pm, err := DefaultTextParser(m)
+	if err != nil {
+		return
+	}
+	if _, ok := f.lastValues[pm.Kind]; ok {
+		f.evictLastValue(pm.Kind)
+		f.lastValues[pm.Kind] = &frame{mtype, m}
+		f.lastValueOrder = append(f.lastValueOrder, pm.Kind)
+		f.retain(len(m))
+		f.enforceLastValueLimits()
+	}
+}
+
+// SetLastValueLimits caps the messages retained by EnableLastValue at maxBytes in total and
+// maxCount messages.  When a new message exceeds a cap, the oldest retained messages are evicted
+// until it is met, and are no longer replayed.  A cap of 0 means no limit.
+//
+// Family last values are the only messages that artemis retains for replay.  Clients have no
+// replay buffer of their own, so there is no per-client cap; each of a client's send queues holds
+// at most 256 messages, which are discarded once they are written or the connection is lost.
+func (f *Family) SetLastValueLimits(maxBytes, maxCount int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxValueBytes = maxBytes
+	f.maxValueCount = maxCount
+	f.enforceLastValueLimits()
+}
+
+// enforceLastValueLimits must be called with f.mu held.
+func (f *Family) enforceLastValueLimits() {
+	for len(f.lastValueOrder) > 0 &&
+		(f.maxValueBytes > 0 && f.lastValueBytes > f.maxValueBytes ||
+			f.maxValueCount > 0 && len(f.lastValueOrder) > f.maxValueCount) {
+		f.evictLastValue(f.lastValueOrder[0])
+	}
+}
+
+// evictLastValue forgets the retained message for kind, if any.  It must be called with f.mu held.
+func (f *Family) evictLastValue(kind string) {
+	last := f.lastValues[kind]
+	if last == nil {
+		return
+	}
+	f.lastValues[kind] = nil
+	f.retain(-len(last.data))
+	for i, k := range f.lastValueOrder {
+		if k == kind {
+			f.lastValueOrder = append(f.lastValueOrder[:i], f.lastValueOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// retain accounts for n more bytes retained by the family.  It must be called with f.mu held.
+func (f *Family) retain(n int) {
+	f.lastValueBytes += n
+	if f.Hub != nil {
+		f.Hub.retain(int64(n))
+	}
+}
+
+func (f *Family) replayLastValues(d MessageDelegate) {
+	f.mu.Lock()
+	replay := make([]*frame, 0, len(f.lastValues))
+	for _, last := range f.lastValues {
+		if last != nil {
+			replay = append(replay, last)
+		}
+	}
+	f.mu.Unlock()
+	for _, last := range replay {
+		d.MessageAgent().PushMessage(last.data, last.mtype)
+	}
 }
 
 func (f *Family) Remove(d Delegate) {
+	wasMember := f.hasMember(d)
 	f.Messages.Remove(d)
 	f.Events.Remove(d)
+	if wasMember {
+		f.left(d)
+	}
+}
+
+// Clear removes all members from the family, unsubscribing each from the family's subscriptions.
+// The family keeps its subscriptions, and can be reused.
+func (f *Family) Clear() {
+	members := make(map[interface{}]struct{})
+	for _, d := range f.Messages.clear() {
+		members[d] = struct{}{}
+	}
+	for _, d := range f.Events.clear() {
+		members[d] = struct{}{}
+	}
+	for m := range members {
+		if d, ok := m.(Delegate); ok {
+			f.left(d)
+		}
+	}
+}
+
+// Size returns the number of members in the family.
+func (f *Family) Size() int {
+	members := make(map[interface{}]struct{})
+	for _, d := range f.Messages.members() {
+		members[d] = struct{}{}
+	}
+	for _, d := range f.Events.members() {
+		members[d] = struct{}{}
+	}
+
+	return len(members)
+}
+
+// CountWhere returns the number of members for which pred returns true.
+func (f *Family) CountWhere(pred func(Delegate) bool) int {
+	count := 0
+	for _, d := range f.members() {
+		if pred(d) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// FindMember returns a member for which pred returns true, if there is one.
+func (f *Family) FindMember(pred func(Delegate) bool) (Delegate, bool) {
+	for _, d := range f.members() {
+		if pred(d) {
+			return d, true
+		}
+	}
+
+	return nil, false
+}
+
+// members returns a snapshot of the members that are both message and event delegates, which
+// includes every member added with Add.
+func (f *Family) members() []Delegate {
+	seen := make(map[interface{}]struct{})
+	var members []Delegate
+	add := func(m interface{}) {
+		if _, ok := seen[m]; ok {
+			return
+		}
+		seen[m] = struct{}{}
+		if d, ok := m.(Delegate); ok {
+			members = append(members, d)
+		}
+	}
+	for _, d := range f.Messages.members() {
+		add(d)
+	}
+	for _, d := range f.Events.members() {
+		add(d)
+	}
+
+	return members
+}
+
+// OnJoin sets a callback that is run with the members added by each call to Add or AddAll.
+func (f *Family) OnJoin(do func([]Delegate)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onJoin = do
+}
+
+func (f *Family) joined(ds []Delegate) {
+	f.mu.Lock()
+	onJoin := f.onJoin
+	f.mu.Unlock()
+	if onJoin != nil {
+		onJoin(ds)
+	}
+}
+
+// OnLeave sets a callback that is run whenever a member is removed from the family.
+func (f *Family) OnLeave(do func(Delegate)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onLeave = do
+}
+
+func (f *Family) left(d Delegate) {
+	f.mu.Lock()
+	onLeave := f.onLeave
+	f.mu.Unlock()
+	if onLeave != nil {
+		onLeave(d)
+	}
+}
+
+// memberLeft fires a MemberLeftKind event about c to the other members, if NotifyOnLeave is set.
+func (f *Family) memberLeft(c *Client, reason error) {
+	if !f.NotifyOnLeave {
+		return
+	}
+	left := &MemberLeft{ID: c.GetID()}
+	if reason != nil {
+		left.Reason = reason.Error()
+	}
+	if closeErr, ok := reason.(*websocket.CloseError); ok {
+		left.Code = closeErr.Code
+	}
+	f.sendOrHold(func() {
+		agents := f.eventAgents(nil)
+		delete(agents, c.Events)
+		deliver(f.Hub, agents, MemberLeftKind, &EventData{left}, f)
+	})
 }
 
 // PushMessage implements MessagePusher
 func (f *Family) PushMessage(m []byte, messageType int) {
-	for d := range f.Messages.subscribers {
-		d.MessageAgent().PushMessage(m, messageType)
+	f.recordLastValue(m, messageType)
+	f.sendOrHold(func() {
+		for _, d := range f.Messages.members() {
+			d.MessageAgent().PushMessage(m, messageType)
+		}
+	})
+}
+
+// Trigger fires an event to the members of the family that subscribe to kind, rather than to
+// the whole hub.
+func (f *Family) Trigger(kind string, data DataGetter, source interface{}) {
+	f.sendOrHold(func() {
+		deliver(f.Hub, f.eventAgents(nil), kind, data, source)
+	})
+}
+
+// PushCapable is like PushMessage, but only sends to members that are clients advertising
+// capability, see Client.HasCapability.  The message is not remembered by EnableLastValue.
+func (f *Family) PushCapable(m []byte, messageType int, capability string) {
+	f.sendOrHold(func() {
+		for _, d := range f.Messages.members() {
+			if c, ok := d.(*Client); ok && c.HasCapability(capability) {
+				c.MessageAgent().PushMessage(m, messageType)
+			}
+		}
+	})
+}
+
+// TriggerCapable is like Trigger, but only fires the event to members that are clients
+// advertising capability, see Client.HasCapability.  The family is the event's source.
+func (f *Family) TriggerCapable(kind string, data DataGetter, capability string) {
+	f.sendOrHold(func() {
+		agents := make(map[*EventAgent]struct{})
+		for _, d := range f.Events.members() {
+			if c, ok := d.(*Client); ok && c.HasCapability(capability) {
+				agents[c.EventAgent()] = struct{}{}
+			}
+		}
+		deliver(f.Hub, agents, kind, data, f)
+	})
+}
+
+// Pause holds back messages pushed and events triggered to the family until Resume is called.  Up
+// to maxQueue of them are held, and the rest are dropped with a warning.  Events broadcast to the
+// whole hub are still delivered to members.
+func (f *Family) Pause(maxQueue int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = true
+	f.maxPaused = maxQueue
+}
+
+// Resume delivers the messages and events held back since Pause, in order, and stops holding
+// them back.  Deliveries made while the held ones are being delivered are held until they have
+// been, so that none overtakes them.
+func (f *Family) Resume() {
+	f.mu.Lock()
+	f.paused = false
+	if f.resuming {
+		// the Resume in progress delivers what is held
+		f.mu.Unlock()
+		return
+	}
+	f.resuming = true
+	for len(f.pausedSend) > 0 && !f.paused {
+		held := f.pausedSend
+		f.pausedSend = nil
+		f.mu.Unlock()
+		for _, send := range held {
+			send()
+		}
+		f.mu.Lock()
 	}
+	f.resuming = false
+	f.mu.Unlock()
+}
+
+// sendOrHold runs send, unless the family is paused or resuming.
+func (f *Family) sendOrHold(send func()) {
+	f.mu.Lock()
+	if !f.paused && !f.resuming {
+		f.mu.Unlock()
+		send()
+		return
+	}
+	defer f.mu.Unlock()
+	if f.paused && len(f.pausedSend) >= f.maxPaused {
+		warn(fmt.Errorf("Family '%s' is paused and its queue is full, dropping delivery.", f.ID))
+		return
+	}
+	f.pausedSend = append(f.pausedSend, send)
+}
+
+// eventAgents adds the event agents of the family's members to agents, creating it if nil.
+func (f *Family) eventAgents(agents map[*EventAgent]struct{}) map[*EventAgent]struct{} {
+	if agents == nil {
+		agents = make(map[*EventAgent]struct{})
+	}
+	for _, d := range f.Events.members() {
+		agents[d.EventAgent()] = struct{}{}
+	}
+
+	return agents
 }
 
 func (f *Family) hasMember(d Delegate) bool {
@@ -38,29 +491,101 @@ func (f *Family) hasMember(d Delegate) bool {
 }
 
 type messageSubscriber struct {
+	family *Family
+
+	mu            sync.Mutex
 	subscribers   map[MessageDelegate]struct{}
 	subscriptions map[string]MessageHandlerSet
+	// asRecipient makes the family the Recipient of messages handled by family subscriptions
+	asRecipient bool
+}
+
+// AsRecipient sets whether the family, rather than the member that received the message, is the
+// Recipient of messages passed to the family's handlers.  It takes effect immediately for all
+// members.
+func (ms *messageSubscriber) AsRecipient(enabled bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.asRecipient = enabled
+}
+
+// subscribeMember subscribes a member's agent to a family handler.  The handler is registered
+// under its own key, so that it can be unsubscribed as usual.
+func (ms *messageSubscriber) subscribeMember(agent *MessageAgent, kind string, do MessageHandler) {
+	wrapped := func(m *Message) {
+		ms.mu.Lock()
+		asRecipient := ms.asRecipient
+		ms.mu.Unlock()
+		if asRecipient {
+			view := *m
+			view.Recipient = ms.family
+			m = &view
+		}
+		do(m)
+	}
+	if err := agent.subscribe(kind, getMessageHandlerKey(do), wrapped); err != nil {
+		warn(err)
+	}
 }
 
 func (ms *messageSubscriber) Add(d MessageDelegate) {
+	if err := ms.add(d); err != nil {
+		warn(err)
+	}
+}
+
+func (ms *messageSubscriber) add(d MessageDelegate) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	if _, ok := ms.subscribers[d]; ok {
-		warn(ErrDuplicateDelegate)
-		return
+		return ErrDuplicateDelegate
 	}
 	agent := d.MessageAgent()
 	for kind, handlers := range ms.subscriptions {
 		for _, h := range handlers {
-			agent.Subscribe(kind, h)
+			ms.subscribeMember(agent, kind, h)
 		}
 	}
 	ms.subscribers[d] = struct{}{}
+	return nil
+}
+
+// addAll adds each of ds that is not already a member, in a single pass over the subscriptions,
+// and reports which were added.
+func (ms *messageSubscriber) addAll(ds []MessageDelegate) []bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	added := make([]bool, len(ds))
+	agents := make([]*MessageAgent, 0, len(ds))
+	for i, d := range ds {
+		if _, ok := ms.subscribers[d]; ok {
+			continue
+		}
+		ms.subscribers[d] = struct{}{}
+		added[i] = true
+		agents = append(agents, d.MessageAgent())
+	}
+	for kind, handlers := range ms.subscriptions {
+		for _, h := range handlers {
+			for _, agent := range agents {
+				ms.subscribeMember(agent, kind, h)
+			}
+		}
+	}
+	return added
 }
 
 func (ms *messageSubscriber) Remove(d MessageDelegate) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	if _, ok := ms.subscribers[d]; !ok {
 		warn(ErrNoDelegates)
 		return
 	}
+	ms.remove(d)
+}
+
+func (ms *messageSubscriber) remove(d MessageDelegate) {
 	agent := d.MessageAgent()
 	for kind, handlers := range ms.subscriptions {
 		for _, h := range handlers {
@@ -70,17 +595,68 @@ func (ms *messageSubscriber) Remove(d MessageDelegate) {
 	delete(ms.subscribers, d)
 }
 
+// clear removes and returns all members.
+func (ms *messageSubscriber) clear() []MessageDelegate {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	removed := make([]MessageDelegate, 0, len(ms.subscribers))
+	for d := range ms.subscribers {
+		ms.remove(d)
+		removed = append(removed, d)
+	}
+
+	return removed
+}
+
+// members returns a snapshot of the current members.
+func (ms *messageSubscriber) members() []MessageDelegate {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	members := make([]MessageDelegate, 0, len(ms.subscribers))
+	for d := range ms.subscribers {
+		members = append(members, d)
+	}
+
+	return members
+}
+
 func (ms *messageSubscriber) Subscribe(kind string, do MessageHandler) {
+	if err := ms.subscribe(kind, do); err != nil {
+		warn(err)
+	}
+}
+
+// SubscribeMany subscribes all members to each handler's kind.  Kinds that could not be
+// subscribed are reported together in the returned SubscribeErrors.
+func (ms *messageSubscriber) SubscribeMany(handlers map[string]MessageHandler) error {
+	errs := make(SubscribeErrors)
+	for kind, do := range handlers {
+		if err := ms.subscribe(kind, do); err != nil {
+			errs[kind] = err
+		}
+	}
+
+	return errs.orNil()
+}
+
+func (ms *messageSubscriber) subscribe(kind string, do MessageHandler) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	if _, ok := ms.subscriptions[kind]; !ok {
 		ms.subscriptions[kind] = make(MessageHandlerSet)
 	}
-	ms.subscriptions[kind].Add(do)
+	if err := ms.subscriptions[kind].add(getMessageHandlerKey(do), do); err != nil {
+		return err
+	}
 	for sub := range ms.subscribers {
-		sub.MessageAgent().Subscribe(kind, do)
+		ms.subscribeMember(sub.MessageAgent(), kind, do)
 	}
+	return nil
 }
 
 func (ms *messageSubscriber) Unsubscribe(kind string, do MessageHandler) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	if handlers, ok := ms.subscriptions[kind]; ok {
 		handlers.Remove(do)
 	}
@@ -89,35 +665,92 @@ func (ms *messageSubscriber) Unsubscribe(kind string, do MessageHandler) {
 	}
 }
 
+// kinds returns the kinds the family subscribes its members to.
+func (ms *messageSubscriber) kinds() []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	kinds := make([]string, 0, len(ms.subscriptions))
+	for kind := range ms.subscriptions {
+		kinds = append(kinds, kind)
+	}
+
+	return kinds
+}
+
 func (ms *messageSubscriber) hasMember(d MessageDelegate) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	_, ok := ms.subscribers[d]
 	return ok
 }
 
 type eventSubscriber struct {
+	mu            sync.Mutex
 	subscribers   map[EventDelegate]struct{}
 	subscriptions map[string]EventHandlerSet
+	// anyHandlers holds the handlers that members run in place of those added with SubscribeAny,
+	// by queue key
+	anyHandlers map[string]EventHandler
 }
 
 func (es *eventSubscriber) Add(d EventDelegate) {
+	if err := es.add(d); err != nil {
+		warn(err)
+	}
+}
+
+func (es *eventSubscriber) add(d EventDelegate) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 	if _, ok := es.subscribers[d]; ok {
-		warn(ErrDuplicateDelegate)
-		return
+		return ErrDuplicateDelegate
 	}
 	agent := d.EventAgent()
 	for kind, handlers := range es.subscriptions {
 		for _, h := range handlers {
-			agent.Subscribe(kind, h)
+			es.subscribeMember(agent, kind, h)
 		}
 	}
 	es.subscribers[d] = struct{}{}
+	return nil
+}
+
+// addAll adds each of ds that is not already a member, in a single pass over the subscriptions,
+// and reports which were added.
+func (es *eventSubscriber) addAll(ds []EventDelegate) []bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	added := make([]bool, len(ds))
+	agents := make([]*EventAgent, 0, len(ds))
+	for i, d := range ds {
+		if _, ok := es.subscribers[d]; ok {
+			continue
+		}
+		es.subscribers[d] = struct{}{}
+		added[i] = true
+		agents = append(agents, d.EventAgent())
+	}
+	for kind, handlers := range es.subscriptions {
+		for _, h := range handlers {
+			for _, agent := range agents {
+				es.subscribeMember(agent, kind, h)
+			}
+		}
+	}
+	return added
 }
 
 func (es *eventSubscriber) Remove(d EventDelegate) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 	if _, ok := es.subscribers[d]; !ok {
 		warn(ErrNoDelegates)
 		return
 	}
+	es.remove(d)
+}
+
+func (es *eventSubscriber) remove(d EventDelegate) {
 	agent := d.EventAgent()
 	for kind, handlers := range es.subscriptions {
 		for _, h := range handlers {
@@ -127,26 +760,153 @@ func (es *eventSubscriber) Remove(d EventDelegate) {
 	delete(es.subscribers, d)
 }
 
+// clear removes and returns all members.
+func (es *eventSubscriber) clear() []EventDelegate {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	removed := make([]EventDelegate, 0, len(es.subscribers))
+	for d := range es.subscribers {
+		es.remove(d)
+		removed = append(removed, d)
+	}
+
+	return removed
+}
+
+// members returns a snapshot of the current members.
+func (es *eventSubscriber) members() []EventDelegate {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	members := make([]EventDelegate, 0, len(es.subscribers))
+	for d := range es.subscribers {
+		members = append(members, d)
+	}
+
+	return members
+}
+
 func (es *eventSubscriber) Subscribe(kind string, do EventHandler) {
+	if err := es.subscribe(kind, do); err != nil {
+		warn(err)
+	}
+}
+
+// SubscribeMany subscribes all members to each handler's kind.  Kinds that could not be
+// subscribed are reported together in the returned SubscribeErrors.
+func (es *eventSubscriber) SubscribeMany(handlers map[string]EventHandler) error {
+	errs := make(SubscribeErrors)
+	for kind, do := range handlers {
+		if err := es.subscribe(kind, do); err != nil {
+			errs[kind] = err
+		}
+	}
+
+	return errs.orNil()
+}
+
+func (es *eventSubscriber) subscribe(kind string, do EventHandler) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 	if _, ok := es.subscriptions[kind]; !ok {
 		es.subscriptions[kind] = make(EventHandlerSet)
 	}
-	es.subscriptions[kind].Add(do)
+	if err := es.subscriptions[kind].add(getEventHandlerKey(do), do); err != nil {
+		return err
+	}
 	for sub := range es.subscribers {
-		sub.EventAgent().Subscribe(kind, do)
+		es.subscribeMember(sub.EventAgent(), kind, do)
+	}
+	return nil
+}
+
+// SubscribeAny subscribes all members to kind, but each event is handled by only one of them:
+// whichever member's agent gets to it first.  This distributes events of kind among the members,
+// for example to hand each job to a single worker.  Events are told apart by their HubSeq.
+func (es *eventSubscriber) SubscribeAny(kind string, do EventHandler) {
+	claims := newEventClaims()
+	es.mu.Lock()
+	if es.anyHandlers == nil {
+		es.anyHandlers = make(map[string]EventHandler)
+	}
+	key := getEventQueueKey(kind, do)
+	_, exists := es.anyHandlers[key]
+	if !exists {
+		es.anyHandlers[key] = func(e *Event) {
+			if claims.claim(e.HubSeq) {
+				do(e)
+			}
+		}
+	}
+	es.mu.Unlock()
+	if exists {
+		warn(ErrDuplicateHandler)
+		return
+	}
+	if err := es.subscribe(kind, do); err != nil {
+		es.mu.Lock()
+		delete(es.anyHandlers, key)
+		es.mu.Unlock()
+		warn(err)
+	}
+}
+
+// subscribeMember subscribes agent to a family handler, in its SubscribeAny form if it has one.
+func (es *eventSubscriber) subscribeMember(agent *EventAgent, kind string, do EventHandler) {
+	handler := do
+	if wrapped, ok := es.anyHandlers[getEventQueueKey(kind, do)]; ok {
+		handler = wrapped
+	}
+	if err := agent.subscribe(kind, getEventHandlerKey(do), handler); err != nil {
+		warn(err)
 	}
 }
 
 func (es *eventSubscriber) Unsubscribe(kind string, do EventHandler) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 	if handlers, ok := es.subscriptions[kind]; ok {
 		handlers.Remove(do)
 	}
+	delete(es.anyHandlers, getEventQueueKey(kind, do))
 	for sub := range es.subscribers {
 		sub.EventAgent().Unsubscribe(kind, do)
 	}
 }
 
 func (es *eventSubscriber) hasMember(d EventDelegate) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 	_, ok := es.subscribers[d]
 	return ok
 }
+
+// maxClaimedEvents is the number of events that SubscribeAny remembers having handled.
+const maxClaimedEvents = 1024
+
+// eventClaims records which events a SubscribeAny handler has been run for, so that only the
+// first member to receive each event runs it.
+type eventClaims struct {
+	mu      sync.Mutex
+	claimed map[uint64]struct{}
+	order   []uint64
+}
+
+func newEventClaims() *eventClaims {
+	return &eventClaims{claimed: make(map[uint64]struct{})}
+}
+
+// claim reports whether seq had not been claimed yet, claiming it.
+func (c *eventClaims) claim(seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.claimed[seq]; ok {
+		return false
+	}
+	c.claimed[seq] = struct{}{}
+	c.order = append(c.order, seq)
+	if len(c.order) > maxClaimedEvents {
+		delete(c.claimed, c.order[0])
+		c.order = c.order[1:]
+	}
+	return true
+}
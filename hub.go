@@ -1,13 +1,25 @@
 package artemis
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+// maxDroppedSeqs is the number of dropped event sequence numbers retained for each subscriber.
+const maxDroppedSeqs = 1024
+
 var (
-	hubs = make(map[string]*Hub)
+	hubs   = make(map[string]*Hub)
+	hubsMu sync.Mutex
 
 	// DefaultHub is a singleton that allows the library to be used without really worrying about
 	// the Hub API.  If only a single hub is needed, then this is a fine solution.
@@ -17,107 +29,664 @@ var (
 
 	// ErrDuplicateHubID indicates that hub creation failed because the name is already in use.
 	ErrDuplicateHubID = errors.New("A hub with that ID already exists.")
+
+	// ErrMemoryPressure indicates that a connection was closed because the hub's MaxInflightBytes
+	// would have been exceeded.
+	ErrMemoryPressure = errors.New("Closing connection, too many bytes in flight in the hub.")
+
+	// ErrTooManyEventKinds indicates that a subscription was rejected because it would give the hub
+	// more distinct event kinds than its MaxEventKinds allows.
+	ErrTooManyEventKinds = errors.New("Subscription rejected, the hub has too many event kinds.")
+
+	// ErrHubDraining indicates that a connection was refused because the hub is shutting down.
+	ErrHubDraining = errors.New("The hub is shutting down and is not accepting connections.")
+
+	// ErrNoRoute indicates that RouteToHub found no hub for a request.
+	ErrNoRoute = errors.New("No hub to handle the request.")
+
+	// ErrFamilyNotFound indicates that no family with the requested ID exists in the hub.
+	ErrFamilyNotFound = errors.New("No family with that ID exists in the hub.")
 )
 
 // Hub is an isolated system for communication among member EventResponders
 // An EventResponder should only belong to a single Hub at any given time.
 // Hub does not interact with messages at all.
 type Hub struct {
+	// inflight, eventSeq, runningHandlers and retained are accessed atomically and must stay
+	// 64-bit aligned
+	inflight        int64
+	eventSeq        uint64
+	runningHandlers int64
+	retained        int64
+	draining        int32
+
 	ID string
 
+	// MaxInflightBytes limits the total size of received messages that are being handled by all of
+	// the hub's agents at once.  Connections that receive a message that would exceed the limit are
+	// closed with ErrMemoryPressure.  0 means no limit.
+	MaxInflightBytes int64
+
+	// MaxFamiliesPerClient limits the number of the hub's families that a client may belong to
+	// when joining with Client.Join.  It is only enforced by Client.Join; adding a client with
+	// Family.Add or Family.AddAll bypasses it.  0 means no limit.
+	MaxFamiliesPerClient int
+
+	// MaxEventKinds limits the number of distinct event kinds that the hub's agents may subscribe
+	// to, so that clients subscribing to arbitrary kinds can't grow its subscriptions without bound.
+	// Subscriptions to further kinds are rejected with ErrTooManyEventKinds.  0 means no limit.
+	MaxEventKinds int
+
+	// PresenceDebounce is how long presence changes are batched before OnPresenceChange fires.
+	PresenceDebounce time.Duration
+
+	// AuthExtractor, if set, is called with the request for each new client before it is upgraded.
+	// The values it returns are stored in the client's metadata.  If it returns an error, the
+	// upgrade is rejected with http.StatusUnauthorized.
+	AuthExtractor func(*http.Request) (map[string]interface{}, error)
+
+	// ConnectedKind and DisconnectedKind are the kinds of the events that the hub broadcasts when
+	// a client connects or disconnects, with the client as the event's data and source.  They
+	// default to DefaultConnectedKind and DefaultDisconnectedKind, and an empty kind disables the
+	// event.
+	ConnectedKind    string
+	DisconnectedKind string
+
+	// SynchronousDelivery makes broadcasts run their subscribers' handlers inline, one event at a
+	// time, instead of sending the event to each agent to be handled on its own goroutine.  Every
+	// handler of one event finishes before any handler of the next begins, at the cost of
+	// throughput: a slow handler holds up all delivery, and agents no longer handle events in
+	// parallel.  A broadcast made while another is being delivered, including by a handler, is
+	// queued and delivered in order by the goroutine that is already delivering, so it may return
+	// before its handlers have run.  Events sent directly to agents, such as by families, are not
+	// affected.
+	SynchronousDelivery bool
+
+	mu            sync.RWMutex
+	agents        map[*MessageAgent]struct{}
+	clients       map[*MessageAgent]*Client
+	presence      presence
 	families      map[string]*Family
 	subscriptions map[string]SubscriptionSet
+
+	// protocols lists the subprotocols with registered parsers, in order of preference.
+	protocols []string
+	parsers   map[string]MessageParser
+
+	beforeUpgrade   func(*http.Request) (int, error)
+	accepts         *acceptLimit
+	acceptRate      *tokenBucket
+	declaredKinds   map[string]interface{}
+	breaker         *circuitBreaker
+	redelivery      *redelivery
+	deadLetters     chan *Event
+	handlerSlots    chan struct{}
+	eventMiddleware []EventMiddleware
+	taps            []*eventTap
+	coalescer       coalescer
+	// droppedSeqs records the HubSeq of events that could not be sent to each subscriber
+	droppedSeqs map[chan *Event][]uint64
+	// unhandled counts broadcasts that had no subscribers, by kind
+	unhandled map[string]int
+	// ctx is cancelled when the hub begins to be destroyed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// handlerRuns tracks the handlers that are running, see InFlight
+	handlerRuns handlerRuns
+	sampler     sampler
+	synchronous synchronousDelivery
+	// eventAgents finds the agent that owns each subscribed channel, for SynchronousDelivery
+	eventAgents map[chan *Event]*EventAgent
 }
 
 // NewHub creates a new Hub with a unique name. If the ID is already in use
 // NewHub returns the hub with that ID as well as ErrDuplicateHubID
 func NewHub(id string) (*Hub, error) {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
 	if _, ok := hubs[id]; ok {
 		// TODO testcase for ErrDuplicate with h returned
 		return hubs[id], ErrDuplicateHubID
 	}
 
+	h := newHub(id)
+	hubs[id] = h
+
+	return h, nil
+}
+
+// CloneConfig creates a new hub with the given ID and the same configuration as h: parsers,
+// upgrade hook, auth extractor, lifecycle event kinds, declared kinds, limits, circuit breaker,
+// redelivery, event middleware and coalescing.  The new hub has no clients, families or
+// subscriptions, and none of h's observers such as taps and presence callbacks.
+func (h *Hub) CloneConfig(newID string) (*Hub, error) {
+	clone, err := NewHub(newID)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.RLock()
+	clone.MaxInflightBytes = h.MaxInflightBytes
+	clone.MaxFamiliesPerClient = h.MaxFamiliesPerClient
+	clone.MaxEventKinds = h.MaxEventKinds
+	clone.PresenceDebounce = h.PresenceDebounce
+	clone.AuthExtractor = h.AuthExtractor
+	clone.ConnectedKind = h.ConnectedKind
+	clone.DisconnectedKind = h.DisconnectedKind
+	clone.SynchronousDelivery = h.SynchronousDelivery
+	clone.protocols = append([]string(nil), h.protocols...)
+	for subprotocol, p := range h.parsers {
+		clone.parsers[subprotocol] = p
+	}
+	clone.beforeUpgrade = h.beforeUpgrade
+	for kind, schema := range h.declaredKinds {
+		clone.declaredKinds[kind] = schema
+	}
+	if h.accepts != nil {
+		clone.accepts = &acceptLimit{slots: make(chan struct{}, cap(h.accepts.slots)), queue: h.accepts.queue}
+	}
+	if h.acceptRate != nil {
+		clone.acceptRate = newTokenBucket(h.acceptRate.rate, int(h.acceptRate.burst))
+	}
+	if h.breaker != nil {
+		clone.breaker = newCircuitBreaker(h.breaker.threshold, h.breaker.window, h.breaker.cooldown)
+	}
+	if h.redelivery != nil {
+		rd := *h.redelivery
+		clone.redelivery = &rd
+	}
+	if h.handlerSlots != nil {
+		clone.handlerSlots = make(chan struct{}, cap(h.handlerSlots))
+	}
+	clone.eventMiddleware = append([]EventMiddleware(nil), h.eventMiddleware...)
+	h.mu.RUnlock()
+
+	h.coalescer.mu.Lock()
+	for kind, window := range h.coalescer.windows {
+		clone.CoalesceBroadcasts(kind, window)
+	}
+	h.coalescer.mu.Unlock()
+
+	return clone, nil
+}
+
+func newHub(id string) *Hub {
 	h := &Hub{}
 	h.ID = id
+	h.PresenceDebounce = 100 * time.Millisecond
+	h.ConnectedKind = DefaultConnectedKind
+	h.DisconnectedKind = DefaultDisconnectedKind
+	h.agents = make(map[*MessageAgent]struct{})
+	h.clients = make(map[*MessageAgent]*Client)
+	h.families = make(map[string]*Family)
 	h.subscriptions = make(map[string]SubscriptionSet)
-	hubs[id] = h
+	h.eventAgents = make(map[chan *Event]*EventAgent)
+	h.parsers = make(map[string]MessageParser)
+	h.declaredKinds = make(map[string]interface{})
+	h.droppedSeqs = make(map[chan *Event][]uint64)
+	h.unhandled = make(map[string]int)
+	h.deadLetters = make(chan *Event, 256)
+	h.ctx, h.cancel = context.WithCancel(context.Background())
 
-	return h, nil
+	return h
 }
 
 // DefaultHub can be used in situations where all EventResponders in the app
 // share the same namespace and are allowed to communicate with one another.
-// It is loaded lazily the first time this function is called.
+// It is loaded lazily the first time this function is called, and is registered
+// alongside other hubs until it is released.
 func DefaultHub() *Hub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
 	if defaultHub == nil {
-		defaultHub = &Hub{
-			defaultHubID,
-			make(map[string]*Family),
-			make(map[string]SubscriptionSet),
-		}
+		defaultHub = newHub(defaultHubID)
+		hubs[defaultHubID] = defaultHub
 	}
 
 	return defaultHub
 }
 
-func (h *Hub) NewClient(w http.ResponseWriter, r *http.Request) (c *Client, err error) {
+// Hubs returns every registered hub, sorted by ID.  The default hub is included once DefaultHub
+// has created it, unless it has been released.  Hubs that were released are not included.
+func Hubs() []*Hub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	all := make([]*Hub, 0, len(hubs))
+	for _, h := range hubs {
+		all = append(all, h)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ID < all[j].ID
+	})
+
+	return all
+}
+
+// HubCount returns the number of registered hubs, counted the same way as Hubs.
+func HubCount() int {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	return len(hubs)
+}
+
+// Release removes the hub from the global registry without closing any connections, for
+// cases where the app keeps its own reference to the hub.  Releasing the default hub means
+// that the next call to DefaultHub creates a new one.
+func (h *Hub) Release() {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	if hubs[h.ID] == h {
+		delete(hubs, h.ID)
+	}
+	if defaultHub == h {
+		defaultHub = nil
+	}
+}
+
+// Destroy cancels the hub's Context, releases the hub, disconnects every message agent created by
+// it, and drops all of its families and event subscriptions.
+func (h *Hub) Destroy() {
+	h.cancel()
+	h.Release()
+
+	h.mu.Lock()
+	agents := h.agents
+	for _, c := range h.clients {
+		removeFromDirectory(c)
+	}
+	h.agents = make(map[*MessageAgent]struct{})
+	h.clients = make(map[*MessageAgent]*Client)
+	h.families = make(map[string]*Family)
+	h.subscriptions = make(map[string]SubscriptionSet)
+	h.eventAgents = make(map[chan *Event]*EventAgent)
+	h.droppedSeqs = make(map[chan *Event][]uint64)
+	h.mu.Unlock()
+
+	for agent := range agents {
+		agent.disconnect(websocket.CloseGoingAway)
+	}
+}
+
+// DrainAndDestroy shuts the hub down gracefully.  It cancels the hub's Context, stops accepting
+// connections, sends notice to every connected client, and waits for everything queued for the
+// clients to be sent before destroying the hub, which closes every connection with
+// CloseGoingAway.  If ctx is done before the clients' queues are flushed, the hub is destroyed
+// anyway and ctx's error is returned.
+func (h *Hub) DrainAndDestroy(ctx context.Context, notice []byte, mtype int) error {
+	atomic.StoreInt32(&h.draining, 1)
+	h.cancel()
+	h.mu.RLock()
+	agents := make([]*MessageAgent, 0, len(h.agents))
+	for agent := range h.agents {
+		agents = append(agents, agent)
+	}
+	h.mu.RUnlock()
+
+	var err error
+	for _, agent := range agents {
+		if pushErr := agent.TryPushMessage(notice, mtype); pushErr != nil {
+			err = pushErr
+		}
+	}
+	for _, agent := range agents {
+		agent.waitFlushed(ctx)
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	h.Destroy()
+
+	return err
+}
+
+// Context returns a context that is cancelled when the hub begins to be destroyed, by Destroy or
+// DrainAndDestroy.  Long running handlers, and goroutines that the app starts on behalf of the
+// hub, should select on its Done channel and wind down when it is closed.
+func (h *Hub) Context() context.Context {
+	return h.ctx
+}
+
+func (h *Hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// NewClient upgrades the request and creates a client for the connection.  Options that apply to
+// the connection, such as HandshakeTimeoutOption and AuthFirstOption, are honored and the rest
+// are ignored.
+func (h *Hub) NewClient(w http.ResponseWriter, r *http.Request, opts ...HandlerOption) (c *Client, err error) {
+	cfg := newHandlerConfig(opts)
 	c = &Client{}
+	c.SetID(SessionIDGenerator())
+	if h.AuthExtractor != nil {
+		values, err := h.AuthExtractor(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return nil, err
+		}
+		for key, value := range values {
+			c.SetMetadata(key, value)
+		}
+	}
 
-	c.Messages, err = h.NewMessageAgent(w, r)
-	if err != nil {
+	c.Messages = h.NewUnconnectedMessageAgent()
+	// the first frame may be an auth frame, which needs the client to store the identity in
+	c.Messages.SetDelegate(c)
+	if cfg.authVerify != nil {
+		c.Messages.ExpectAuthFirst(cfg.authTimeout, cfg.authVerify)
+	}
+	if err = c.Messages.connect(w, r, cfg.handshakeTimeout); err != nil {
 		return nil, err
 	}
+	c.Messages.register()
 	c.Events = h.NewEventAgent()
-	c.Messages.Delegate = c
-	c.Events.Delegate = c
+	c.Events.SetDelegate(c)
+	c.Messages.OnDisconnect(c.notifyFamilies)
+	h.registerClient(c)
 
 	return
 }
 
+// NewFamily creates a family with the given ID in the hub.  If a family with that ID already
+// exists in the hub, it is returned instead.
 func (h *Hub) NewFamily(id string) *Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if _, ok := h.families[id]; ok {
 		return h.families[id]
 	}
 	f := &Family{}
+	f.ID = id
 	f.Hub = h
 
-	f.Messages = messageSubscriber{
-		make(map[MessageDelegate]struct{}),
-		make(map[string]MessageHandlerSet),
-	}
-	f.Events = eventSubscriber{
-		make(map[EventDelegate]struct{}),
-		make(map[string]EventHandlerSet),
-	}
+	f.Messages.family = f
+	f.Messages.subscribers = make(map[MessageDelegate]struct{})
+	f.Messages.subscriptions = make(map[string]MessageHandlerSet)
+	f.Events.subscribers = make(map[EventDelegate]struct{})
+	f.Events.subscriptions = make(map[string]EventHandlerSet)
 	h.families[id] = f
 
 	return f
 }
 
+// InflightBytes returns the total size of received messages currently being handled by the
+// hub's agents.
+func (h *Hub) InflightBytes() int64 {
+	return atomic.LoadInt64(&h.inflight)
+}
+
+// RetainedBytes returns the total size of the messages that the hub's families retain for replay
+// to new members.  See Family.EnableLastValue and Family.SetLastValueLimits.  Messages queued to
+// be sent to clients are not retained for replay, and are not counted.
+func (h *Hub) RetainedBytes() int64 {
+	return atomic.LoadInt64(&h.retained)
+}
+
+func (h *Hub) retain(n int64) {
+	atomic.AddInt64(&h.retained, n)
+}
+
+// reserveInflight accounts for n bytes being handled, unless that would exceed MaxInflightBytes.
+func (h *Hub) reserveInflight(n int64) bool {
+	for {
+		current := atomic.LoadInt64(&h.inflight)
+		if h.MaxInflightBytes > 0 && current+n > h.MaxInflightBytes {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&h.inflight, current, current+n) {
+			return true
+		}
+	}
+}
+
+func (h *Hub) releaseInflight(n int64) {
+	atomic.AddInt64(&h.inflight, -n)
+}
+
+// Family returns the family in the hub with the given ID, if there is one.
+func (h *Hub) Family(id string) (*Family, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	f, ok := h.families[id]
+	return f, ok
+}
+
+// allFamilies returns a snapshot of the hub's families.
+func (h *Hub) allFamilies() []*Family {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	families := make([]*Family, 0, len(h.families))
+	for _, f := range h.families {
+		families = append(families, f)
+	}
+
+	return families
+}
+
 func (h *Hub) NewEventAgent() *EventAgent {
 	a := &EventAgent{}
 	a.Hub = h
 	a.events = make(chan *Event, 256)
 	a.ready = false
 	a.subscriptions = make(map[string]EventHandlerSet)
+	a.queues = make(map[string]*eventQueue)
 
 	return a
 }
 
 // TODO tj - this should be protocol agnostic - for now, just pass in the http params
+// If an error is returned, an error response has already been written to w.
 func (h *Hub) NewMessageAgent(w http.ResponseWriter, r *http.Request) (*MessageAgent, error) {
-	agent := &MessageAgent{}
-	err := agent.connect(w, r)
+	agent := h.NewUnconnectedMessageAgent()
+	err := agent.Connect(w, r)
 	if err != nil {
 		return nil, err
 	}
-	agent.Hub = h
 
+	return agent, nil
+}
+
+// NewUnconnectedMessageAgent creates a MessageAgent that can subscribe to messages, but has no
+// connection until Connect is called.
+func (h *Hub) NewUnconnectedMessageAgent() *MessageAgent {
+	agent := &MessageAgent{}
+	agent.Hub = h
 	agent.sendText = make(chan []byte, 256)
 	agent.sendBinary = make(chan []byte, 256)
+	agent.sendPriority = make(chan frame, 256)
+	agent.done = make(chan struct{})
 	agent.subscriptions = make(map[string]MessageHandlerSet)
 
-	return agent, nil
+	return agent
+}
+
+// HandlerOption configures the http.Handler returned by Hub.Handler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	kindsPath        string
+	handshakeTimeout time.Duration
+	authTimeout      time.Duration
+	authVerify       func([]byte) (interface{}, error)
+}
+
+func newHandlerConfig(opts []HandlerOption) *handlerConfig {
+	cfg := &handlerConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// KindDiscovery makes the handler serve the hub's KindInfo as JSON for requests to path, rather
+// than upgrading them.
+func KindDiscovery(path string) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.kindsPath = path
+	}
+}
+
+// HandshakeTimeoutOption overrides HandshakeTimeout for upgrades made by the handler.
+func HandshakeTimeoutOption(timeout time.Duration) HandlerOption {
+	return func(cfg *handlerConfig) {
+		cfg.handshakeTimeout = timeout
+	}
+}
+
+// Handler returns an http.Handler that creates a Client on the hub for each request and passes it
+// to onConnect, which may be nil.
+func (h *Hub) Handler(onConnect func(*Client), opts ...HandlerOption) http.Handler {
+	cfg := newHandlerConfig(opts)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.kindsPath != "" && r.URL.Path == cfg.kindsPath {
+			h.serveKinds(w, r)
+			return
+		}
+		c, err := h.NewClient(w, r, opts...)
+		if err != nil {
+			// the error response has already been written
+			return
+		}
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+}
+
+// RouteToHub returns an http.Handler that serves each request like the Handler of the hub that
+// route returns for it, e.g. based on the request's Origin, path or headers.  If route returns an
+// error or a nil hub, the request is rejected with http.StatusBadRequest.
+func RouteToHub(route func(*http.Request) (*Hub, error), onConnect func(*Client), opts ...HandlerOption) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, err := route(r)
+		if err == nil && h == nil {
+			err = ErrNoRoute
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.Handler(onConnect, opts...).ServeHTTP(w, r)
+	})
+}
+
+// KindInfo describes a message kind that the hub handles.  Schema is nil unless the kind was
+// declared with one.
+type KindInfo struct {
+	Kind   string      `json:"kind"`
+	Schema interface{} `json:"schema,omitempty"`
+}
+
+// DeclareKind advertises a message kind, with an optional schema describing its data, whether or
+// not any agent currently subscribes to it.
+func (h *Hub) DeclareKind(kind string, schema interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.declaredKinds[kind] = schema
+}
+
+// RegisteredKinds returns the sorted, distinct message kinds that are declared on the hub or
+// subscribed to by its connected agents and families.
+func (h *Hub) RegisteredKinds() []string {
+	infos := h.KindInfo()
+	kinds := make([]string, len(infos))
+	for i, info := range infos {
+		kinds[i] = info.Kind
+	}
+
+	return kinds
+}
+
+// KindInfo returns a description of each of the hub's RegisteredKinds.
+func (h *Hub) KindInfo() []KindInfo {
+	h.mu.RLock()
+	kinds := make(map[string]interface{})
+	for agent := range h.agents {
+		for _, kind := range agent.kinds() {
+			kinds[kind] = nil
+		}
+	}
+	for _, f := range h.families {
+		for _, kind := range f.Messages.kinds() {
+			kinds[kind] = nil
+		}
+	}
+	for kind, schema := range h.declaredKinds {
+		kinds[kind] = schema
+	}
+	h.mu.RUnlock()
+
+	infos := make([]KindInfo, 0, len(kinds))
+	for kind, schema := range kinds {
+		infos = append(infos, KindInfo{kind, schema})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Kind < infos[j].Kind
+	})
+
+	return infos
+}
+
+func (h *Hub) serveKinds(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.KindInfo()); err != nil {
+		throw(err)
+	}
+}
+
+// BeforeUpgrade sets a hook that is consulted before each connection to the hub is upgraded.
+// If the hook returns an error, the upgrade is aborted and the returned status code is written
+// to the response (http.StatusForbidden if the status code is 0).
+func (h *Hub) BeforeUpgrade(hook func(*http.Request) (int, error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.beforeUpgrade = hook
+}
+
+// checkUpgrade runs the BeforeUpgrade hook, if any.  If the upgrade is rejected, the error
+// response has already been written when checkUpgrade returns.
+func (h *Hub) checkUpgrade(w http.ResponseWriter, r *http.Request) error {
+	h.mu.RLock()
+	hook := h.beforeUpgrade
+	h.mu.RUnlock()
+	if hook == nil {
+		return nil
+	}
+	status, err := hook(r)
+	if err != nil {
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+	}
+
+	return err
+}
+
+// RegisterProtocolParser offers subprotocol to clients during the handshake.  Message agents
+// whose clients negotiate subprotocol use p to parse messages, unless they set their own Parser.
+// Subprotocols are preferred in the order they are registered.
+func (h *Hub) RegisterProtocolParser(subprotocol string, p MessageParser) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.parsers[subprotocol]; !ok {
+		h.protocols = append(h.protocols, subprotocol)
+	}
+	h.parsers[subprotocol] = p
+}
+
+func (h *Hub) subprotocols() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]string(nil), h.protocols...)
+}
+
+func (h *Hub) protocolParser(subprotocol string) (MessageParser, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	p, ok := h.parsers[subprotocol]
+	return p, ok
 }
 
 // PushMessage implements MessagePusher
@@ -127,31 +696,312 @@ func (h *Hub) NewMessageAgent(w http.ResponseWriter, r *http.Request) (*MessageA
 
 // Broadcast informs all subscribed listeners to eventKind of the event.  Source is optionally
 // available as source of the event, and can be nil.
+//
+// Broadcast never blocks on a subscriber, and delivery is not guaranteed: a subscriber whose
+// event buffer is full misses the event, with a warning.  Every event carries a HubSeq, and the
+// HubSeqs of the events a subscriber missed are available from EventAgent.DroppedSeqs, so that
+// gaps can be detected and recovered from.
 func (h *Hub) Broadcast(eventKind string, data DataGetter, source interface{}) {
-	if subscribers, ok := h.subscriptions[eventKind]; ok {
-		for sub := range subscribers {
-			e := newEvent(eventKind, data)
-			e.Source = source
-			sub <- e
+	h.broadcast(eventKind, data, source, nil, nil)
+}
+
+// BroadcastSampled is like Broadcast, but each subscriber receives the event with probability
+// fraction, to limit the load of high volume events.  See SetSamplingSeed.
+func (h *Hub) BroadcastSampled(eventKind string, data DataGetter, source interface{}, fraction float64) {
+	h.broadcast(eventKind, data, source, nil, h.sampler.filter(fraction))
+}
+
+// RebroadcastMessageAsEvent broadcasts an event with the kind and data of a received message, so
+// that event subscribers can handle it.  The message's Recipient, usually the client that
+// received it, is the event's source.
+func (h *Hub) RebroadcastMessageAsEvent(m *Message) {
+	h.broadcast(m.Kind, &EventData{m.Data}, m.Recipient, nil, nil)
+}
+
+// BroadcastAck is like Broadcast, but returns a channel that is closed once every handler of
+// every subscribed agent has run to completion.  If there are no subscribers, the channel is
+// closed immediately.
+func (h *Hub) BroadcastAck(eventKind string, data DataGetter, source interface{}) <-chan struct{} {
+	acks := &sync.WaitGroup{}
+	done := make(chan struct{})
+	h.broadcast(eventKind, data, source, acks, nil)
+	go func() {
+		acks.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// broadcast sends an event to the subscribers of its kind that filter selects, or to every
+// subscriber if filter is nil.
+func (h *Hub) broadcast(eventKind string, data DataGetter, source interface{}, acks *sync.WaitGroup, filter subscriberFilter) {
+	if !h.SynchronousDelivery {
+		h.publish(eventKind, data, source, acks, filter, false)
+		return
+	}
+	if acks != nil {
+		// the broadcast may be queued behind others, so acks must not be waited on until it runs
+		acks.Add(1)
+	}
+	h.synchronous.run(func() {
+		h.publish(eventKind, data, source, acks, filter, true)
+		if acks != nil {
+			acks.Done()
 		}
-	} else {
-		warn(fmt.Errorf("Hub fired event of kind '%s' but no one was listening.", eventKind))
+	})
+}
+
+// publish runs the event middleware and sends the event to the selected subscribers, or runs
+// their handlers inline if inline is true.
+func (h *Hub) publish(eventKind string, data DataGetter, source interface{}, acks *sync.WaitGroup, filter subscriberFilter, inline bool) {
+	proto := newEvent(eventKind, data)
+	proto.Source = source
+	h.mu.RLock()
+	middleware, taps := h.eventMiddleware, h.taps
+	h.mu.RUnlock()
+
+	reached := false
+	runEventMiddleware(middleware, proto, func() {
+		reached = true
+		subscribers := h.subscribers(proto.Kind)
+		if len(subscribers) == 0 {
+			runTaps(taps, proto, 0)
+			h.mu.Lock()
+			h.unhandled[proto.Kind]++
+			h.mu.Unlock()
+			warn(fmt.Errorf("Hub fired event of kind '%s' but no one was listening.", proto.Kind))
+			return
+		}
+		if filter != nil {
+			subscribers = filter(subscribers)
+		}
+		proto.HubSeq = h.nextEventSeq()
+		proto.acks = acks
+		runTaps(taps, proto, len(subscribers))
+		for _, sub := range subscribers {
+			e := *proto
+			e.expectHandlers(1)
+			if inline {
+				if agent := h.eventAgent(sub); agent != nil {
+					agent.handleEvent(&e, true)
+					continue
+				}
+			}
+			if !h.coalesce(sub, &e) {
+				h.send(sub, &e)
+			}
+		}
+	})
+	if !reached {
+		runTaps(taps, proto, 0)
+	}
+}
+
+// EventKindStats returns the number of subscribers to each kind that has any.
+func (h *Hub) EventKindStats() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stats := make(map[string]int, len(h.subscriptions))
+	for kind, subs := range h.subscriptions {
+		if len(subs) > 0 {
+			stats[kind] = len(subs)
+		}
+	}
+
+	return stats
+}
+
+// UnhandledEventStats returns the number of broadcasts of each kind that had no subscribers, to
+// help find producers of events that nothing handles.
+func (h *Hub) UnhandledEventStats() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stats := make(map[string]int, len(h.unhandled))
+	for kind, count := range h.unhandled {
+		stats[kind] = count
+	}
+
+	return stats
+}
+
+// ResetUnhandledStats clears the counts returned by UnhandledEventStats.
+func (h *Hub) ResetUnhandledStats() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unhandled = make(map[string]int)
+}
+
+// eventTap wraps a tap function so that it can be found again by pointer when cancelled.
+type eventTap struct {
+	do func(e *Event, subscriberCount int)
+}
+
+// Tap adds an observer that sees every event broadcast in the hub, along with the number of
+// subscribers it is sent to.  Events with no subscribers, and events vetoed by middleware, are
+// observed with a subscriberCount of 0.  The event must not be modified.  Calling cancel removes
+// the tap.
+func (h *Hub) Tap(do func(e *Event, subscriberCount int)) (cancel func()) {
+	tap := &eventTap{do}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.taps = append(h.taps, tap)
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, t := range h.taps {
+			if t == tap {
+				// copy so that a broadcast holding the old slice is not affected
+				taps := make([]*eventTap, 0, len(h.taps)-1)
+				taps = append(taps, h.taps[:i]...)
+				h.taps = append(taps, h.taps[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func runTaps(taps []*eventTap, e *Event, subscriberCount int) {
+	for _, tap := range taps {
+		tap.do(e, subscriberCount)
+	}
+}
+
+// EventMiddleware intercepts events broadcast in a hub before they are sent to subscribers.  It
+// may modify the event, and must call next for the broadcast to continue - returning without
+// calling next vetoes the broadcast.
+type EventMiddleware func(e *Event, next func())
+
+// UseEvent adds middleware that runs on every event broadcast in the hub.  Middleware runs in the
+// order it was added.
+func (h *Hub) UseEvent(m EventMiddleware) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.eventMiddleware = append(h.eventMiddleware, m)
+}
+
+func runEventMiddleware(middleware []EventMiddleware, e *Event, final func()) {
+	if len(middleware) == 0 {
+		final()
+		return
+	}
+	middleware[0](e, func() {
+		runEventMiddleware(middleware[1:], e, final)
+	})
+}
+
+func (h *Hub) nextEventSeq() uint64 {
+	return atomic.AddUint64(&h.eventSeq, 1)
+}
+
+// send delivers an event to a subscriber without blocking.  If the subscriber's buffer is full,
+// the event is dropped and its HubSeq recorded.
+func (h *Hub) send(sub chan *Event, e *Event) {
+	select {
+	case sub <- e:
+	default:
+		h.drop(sub, e)
 	}
 }
 
-// Subscribe sets up a subscriptions to a named event, events will be sent over the channel
-func (h *Hub) subscribe(kind string, c chan *Event) {
+// drop gives up on delivering e to a subscriber that is not keeping up, and records it.
+func (h *Hub) drop(sub chan *Event, e *Event) {
+	e.handlerDone()
+	h.mu.Lock()
+	dropped := append(h.droppedSeqs[sub], e.HubSeq)
+	// events may be dropped by the hub or by the agent, so keep them in order
+	for i := len(dropped) - 1; i > 0 && dropped[i] < dropped[i-1]; i-- {
+		dropped[i], dropped[i-1] = dropped[i-1], dropped[i]
+	}
+	if len(dropped) > maxDroppedSeqs {
+		dropped = dropped[len(dropped)-maxDroppedSeqs:]
+	}
+	h.droppedSeqs[sub] = dropped
+	h.mu.Unlock()
+	warn(fmt.Errorf("Subscriber is not keeping up, dropped event '%s' (%d).", e.Kind, e.HubSeq))
+}
+
+// droppedFor returns the HubSeq of events dropped for a subscriber.
+func (h *Hub) droppedFor(sub chan *Event) []uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]uint64(nil), h.droppedSeqs[sub]...)
+}
+
+// HasSubscribers reports whether any agent subscribes to kind, so that producers can skip
+// building event data that no one would receive.
+func (h *Hub) HasSubscribers(kind string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscriptions[kind]) > 0
+}
+
+// subscribers returns a snapshot of the channels subscribed to kind, so that events can be sent
+// without holding the lock.
+func (h *Hub) subscribers(kind string) []chan *Event {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	subs := make([]chan *Event, 0, len(h.subscriptions[kind]))
+	for sub := range h.subscriptions[kind] {
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
+
+// Subscribe sets up a subscriptions to a named event, events will be sent over the agent's channel
+func (h *Hub) subscribe(kind string, agent *EventAgent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if _, ok := h.subscriptions[kind]; !ok {
+		if h.MaxEventKinds > 0 && len(h.subscriptions) >= h.MaxEventKinds {
+			return ErrTooManyEventKinds
+		}
 		h.subscriptions[kind] = make(SubscriptionSet)
 	}
 	// silent on duplicate
-	h.subscriptions[kind].Add(c)
+	h.subscriptions[kind].Add(agent.events)
+	h.eventAgents[agent.events] = agent
+	return nil
 }
 
 func (h *Hub) unsubscribe(kind string, c chan *Event) {
-	if _, ok := h.subscriptions[kind]; ok {
-		h.subscriptions[kind].Remove(c)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if subs, ok := h.subscriptions[kind]; ok {
+		subs.Remove(c)
+		// kinds without subscribers don't count toward MaxEventKinds
+		if len(subs) == 0 {
+			delete(h.subscriptions, kind)
+		}
 	}
+	for _, subs := range h.subscriptions {
+		if _, ok := subs[c]; ok {
+			return
+		}
+	}
+	delete(h.eventAgents, c)
+	delete(h.droppedSeqs, c)
 }
 
-// TODO hub graceful destruction
+// unsubscribeAll removes c from every kind it is subscribed to.
+func (h *Hub) unsubscribeAll(c chan *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for kind, subs := range h.subscriptions {
+		subs.Remove(c)
+		if len(subs) == 0 {
+			delete(h.subscriptions, kind)
+		}
+	}
+	delete(h.eventAgents, c)
+	delete(h.droppedSeqs, c)
+}
+
+// eventAgent returns the agent that owns a subscribed channel.
+func (h *Hub) eventAgent(c chan *Event) *EventAgent {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.eventAgents[c]
+}
@@ -0,0 +1,83 @@
+package artemis
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightHandler describes a handler that is running.
+type InFlightHandler struct {
+	Kind      string
+	Started   time.Time
+	Recipient interface{}
+}
+
+// handlerRun is a running handler that can be cancelled through its context.
+type handlerRun struct {
+	InFlightHandler
+	cancel context.CancelFunc
+}
+
+// handlerRuns is the set of handlers that a hub's agents are running.
+type handlerRuns struct {
+	mu   sync.Mutex
+	runs map[*handlerRun]struct{}
+}
+
+func (hr *handlerRuns) add(run *handlerRun) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if hr.runs == nil {
+		hr.runs = make(map[*handlerRun]struct{})
+	}
+	hr.runs[run] = struct{}{}
+}
+
+func (hr *handlerRuns) remove(run *handlerRun) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	delete(hr.runs, run)
+}
+
+// InFlight returns the handlers that the hub's agents are running, oldest first.
+func (h *Hub) InFlight() []InFlightHandler {
+	h.handlerRuns.mu.Lock()
+	defer h.handlerRuns.mu.Unlock()
+	inFlight := make([]InFlightHandler, 0, len(h.handlerRuns.runs))
+	for run := range h.handlerRuns.runs {
+		inFlight = append(inFlight, run.InFlightHandler)
+	}
+	sort.Slice(inFlight, func(i, j int) bool {
+		return inFlight[i].Started.Before(inFlight[j].Started)
+	})
+
+	return inFlight
+}
+
+// CancelInFlight cancels the context of every handler that the hub's agents are running.  It is
+// up to each handler to notice that its Message or Event Context is done and return early.
+func (h *Hub) CancelInFlight() {
+	h.handlerRuns.mu.Lock()
+	defer h.handlerRuns.mu.Unlock()
+	for run := range h.handlerRuns.runs {
+		run.cancel()
+	}
+}
+
+// trackHandler derives a cancellable context from parent for a handler that is starting, and
+// registers it as in flight until done is called.
+func (h *Hub) trackHandler(kind string, recipient interface{}, parent context.Context) (ctx context.Context, done func()) {
+	run := &handlerRun{}
+	run.Kind = kind
+	run.Started = time.Now()
+	run.Recipient = recipient
+	ctx, run.cancel = context.WithCancel(parent)
+	h.handlerRuns.add(run)
+
+	return ctx, func() {
+		h.handlerRuns.remove(run)
+		run.cancel()
+	}
+}
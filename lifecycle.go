@@ -0,0 +1,20 @@
+package artemis
+
+const (
+	// DefaultConnectedKind is the kind of the event that a hub broadcasts when a client connects,
+	// unless the hub's ConnectedKind is changed.
+	DefaultConnectedKind = "artemis.client.connected"
+	// DefaultDisconnectedKind is the kind of the event that a hub broadcasts when a client
+	// disconnects, unless the hub's DisconnectedKind is changed.
+	DefaultDisconnectedKind = "artemis.client.disconnected"
+)
+
+// broadcastLifecycle broadcasts an event of kind with c as its data and source, if the kind is
+// enabled and has subscribers.  Lifecycle events without subscribers are not reported as
+// unhandled.
+func (h *Hub) broadcastLifecycle(kind string, c *Client) {
+	if kind == "" || !h.HasSubscribers(kind) {
+		return
+	}
+	h.broadcast(kind, &EventData{c}, c, nil, nil)
+}
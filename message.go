@@ -1,8 +1,17 @@
 package artemis
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,6 +27,32 @@ type ParsedMessage struct {
 	Value interface{}
 	Raw   []byte
 	Kind  string
+	// ID is an optional client-supplied identifier for the message.  Empty if not provided.
+	ID string
+	// IdempotencyKey is an optional client-supplied key that is the same for every copy of a
+	// message that the client resends.  See MessageAgent.SetDeduplication.
+	IdempotencyKey string
+}
+
+// parserChain tries each of its parsers in order, using the first that succeeds.
+type parserChain []MessageParser
+
+func (pc parserChain) ParseText(m []byte) (*ParsedMessage, error) {
+	for _, p := range pc {
+		if pm, err := p.ParseText(m); err == nil {
+			return pm, nil
+		}
+	}
+	return nil, ErrUnparseableMessage
+}
+
+func (pc parserChain) ParseBinary(m []byte) (*ParsedMessage, error) {
+	for _, p := range pc {
+		if pm, err := p.ParseBinary(m); err == nil {
+			return pm, nil
+		}
+	}
+	return nil, ErrUnparseableMessage
 }
 
 func NewParsedMessage(kind string, data interface{}, raw []byte) *ParsedMessage {
@@ -30,12 +65,68 @@ func NewParsedMessage(kind string, data interface{}, raw []byte) *ParsedMessage
 }
 
 type Message struct {
-	Kind      string
+	Kind string
+	ID   string
+	// Seq is the position of the message among those received by its agent, starting at 1.
+	Seq       uint64
 	Data      interface{}
 	Recipient interface{}
 	Source    *MessageAgent
 
 	Raw []byte
+
+	ctx context.Context
+}
+
+// Context returns a context that is done when the message's deadline passes, if the client set
+// one (see DeadlineExtractor), or when the connection is lost.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// ToEvent returns an event with the message's Kind, Data and Recipient, and the message's
+// Source as its source, so that messages and events can be handled the same way.
+func (m *Message) ToEvent() *Event {
+	e := newEvent(m.Kind, &EventData{m.Data})
+	e.Recipient = m.Recipient
+	e.Source = m.Source
+
+	return e
+}
+
+// ErrorKind is the kind of every envelope sent by SendError.
+const ErrorKind = "error"
+
+// HandlerErrorCode is the code of the error replies sent when a handler added with SubscribeErr
+// returns an error.
+const HandlerErrorCode = "handlerError"
+
+// ErrorEnvelope is the shape of protocol-level error replies sent to clients.  Kind is always
+// ErrorKind.  RelatedID and RelatedKind identify the message that caused the error, and are
+// omitted if there is no related message.
+type ErrorEnvelope struct {
+	Kind        string `json:"kind"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	RelatedID   string `json:"relatedId,omitempty"`
+	RelatedKind string `json:"relatedKind,omitempty"`
+}
+
+// NewErrorEnvelope creates an ErrorEnvelope, referencing relatedTo if it is not nil.
+func NewErrorEnvelope(code, message string, relatedTo *Message) *ErrorEnvelope {
+	env := &ErrorEnvelope{}
+	env.Kind = ErrorKind
+	env.Code = code
+	env.Message = message
+	if relatedTo != nil {
+		env.RelatedID = relatedTo.ID
+		env.RelatedKind = relatedTo.Kind
+	}
+
+	return env
 }
 
 // MessageResponse is a function that is executed in response to a message.
@@ -50,12 +141,17 @@ func getMessageHandlerKey(h MessageHandler) string {
 
 // Add puts a new MessageHandler into the set.  Warns asynchronously if r is already in the set.
 func (mhs MessageHandlerSet) Add(h MessageHandler) {
-	key := getMessageHandlerKey(h)
+	if err := mhs.add(getMessageHandlerKey(h), h); err != nil {
+		warn(err)
+	}
+}
+
+func (mhs MessageHandlerSet) add(key string, h MessageHandler) error {
 	if _, ok := mhs[key]; ok {
-		warn(ErrDuplicateHandler)
-		return
+		return ErrDuplicateHandler
 	}
 	mhs[key] = h
+	return nil
 }
 
 // Remove ensures that MessageHandler "r" is no longer present in the MessageHandlerSet
@@ -65,19 +161,118 @@ func (mhs MessageHandlerSet) Remove(h MessageHandler) {
 	delete(mhs, key)
 }
 
+// maxPriorityBurst is the most priority frames that are written before the normal send queues
+// get a turn.
+const maxPriorityBurst = 8
+
+// frame is a message queued for sending along with its type.
+type frame struct {
+	mtype int
+	data  []byte
+}
+
+// ConnStats are cumulative counts of the traffic on a connection.
+type ConnStats struct {
+	BytesRead       uint64
+	BytesWritten    uint64
+	MessagesRead    uint64
+	MessagesWritten uint64
+}
+
 type MessageAgent struct {
+	// seq, stats, lastPing, rtt and lastActive are accessed atomically and must stay 64-bit aligned
+	seq   uint64
+	stats ConnStats
+	// lastPing is the UnixNano timestamp carried by the most recent ping
+	lastPing int64
+	// rtt is the round trip time measured by the most recent matching pong
+	rtt int64
+	// lastActive is the UnixNano time of the last message or pong received
+	lastActive int64
+	// pending counts messages that have been queued but not yet written
+	pending    int64
+	missedPong int32
+	// closing is set once a close frame has been sent, after which messages are discarded
+	closing int32
+	// detaching is set while Detach stops the loops
+	detaching int32
+
 	Hub *Hub
 
 	// Parser overrides the default message parsing behavior if defined.  Default is nil
 	Parser MessageParser
 	// Delegate allows another object to act as the Recipient of messages from this agent if defined.
 	// Default is nil.
+	//
+	// Deprecated: assigning Delegate while messages are being received is a data race.  Use
+	// SetDelegate and GetDelegate, which guard it with delegateMu.
 	Delegate interface{}
+	// delegateMu guards Delegate and resolveRecipient
+	delegateMu sync.RWMutex
 
-	subscriptions map[string]MessageHandlerSet
-	conn          *websocket.Conn
-	sendText      chan []byte
-	sendBinary    chan []byte
+	// subscriptionsMu guards subscriptions, which are read while handling messages and may be
+	// changed from any goroutine.  It is never held while handlers run.
+	subscriptionsMu sync.RWMutex
+	subscriptions   map[string]MessageHandlerSet
+	// dispatch defers unsubscribing while handlers are being run
+	dispatch dispatchGuard
+	// dedup remembers recent idempotency keys if deduplication is enabled
+	dedup *dedupCache
+	conn  Conn
+	// extensions lists the extensions negotiated when the agent upgraded its connection
+	extensions []string
+	// writeMu serializes writes of data frames, which may come from the write loop or a stream
+	writeMu      sync.Mutex
+	sendText     chan []byte
+	sendBinary   chan []byte
+	sendPriority chan frame
+	// done is closed once the connection is lost
+	done chan struct{}
+	// stop is closed to stop the current loops when the connection is detached
+	stop     chan struct{}
+	attachMu sync.Mutex
+	// connMu guards conn for readers outside the loops, such as disconnect and cleanup, which may
+	// run while the connection is being detached.  attachMu can't be used, as Detach holds it
+	// while waiting for the loops.
+	connMu      sync.Mutex
+	cleanupOnce sync.Once
+	// loops tracks the read and write goroutines
+	loops sync.WaitGroup
+	// pongJitter is this connection's offset from pongTimeout
+	pongJitter time.Duration
+	// resolveRecipient overrides the default Recipient of received messages if set
+	resolveRecipient func(*Message) interface{}
+	// compressKinds overrides EnableCompression for outgoing messages of each kind
+	compressMu    sync.RWMutex
+	compressKinds map[string]bool
+	// coalesceWindow and coalesceMaxBytes configure write coalescing, see SetWriteCoalesce.  batch
+	// is only used by the write loop.
+	coalesceMu       sync.Mutex
+	coalesceWindow   time.Duration
+	coalesceMaxBytes int
+	batch            writeBatch
+	// eventBatch holds the events waiting to be sent together, see SetBroadcastBatching
+	eventBatchMu     sync.Mutex
+	eventBatchWindow time.Duration
+	eventBatch       []json.RawMessage
+	// auth is the pending verification of the first frame, see ExpectAuthFirst
+	authMu sync.Mutex
+	auth   *firstFrameAuth
+	// readStarted is set once the read loop has started, and the auth timeout can start
+	readStarted int32
+	// lastErr is the most recent error reported for the agent, see Client.LastError
+	errMu       sync.Mutex
+	lastErr     error
+	lastErrTime time.Time
+	// disconnectReason is why the connection was lost, for the OnDisconnect callbacks
+	disconnectMu     sync.Mutex
+	disconnectReason error
+	disconnected     bool
+	onDisconnect     []func(error)
+	// ctx is cancelled when the connection is lost.  It carries the values of the request that
+	// created the connection, if any.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewMessageAgent(w http.ResponseWriter, r *http.Request) (*MessageAgent, error) {
@@ -86,41 +281,428 @@ func NewMessageAgent(w http.ResponseWriter, r *http.Request) (*MessageAgent, err
 	return DefaultHub().NewMessageAgent(w, r)
 }
 
+// NewUnconnectedMessageAgent creates a MessageAgent on the default hub that has no connection
+// until Connect is called.
+func NewUnconnectedMessageAgent() *MessageAgent {
+	return DefaultHub().NewUnconnectedMessageAgent()
+}
+
+// throw reports e like the package level throw, and records it as the agent's last error.
+func (agent *MessageAgent) throw(e error) {
+	agent.errMu.Lock()
+	agent.lastErr, agent.lastErrTime = e, now()
+	agent.errMu.Unlock()
+	throw(e)
+}
+
+func (agent *MessageAgent) lastError() (error, time.Time) {
+	agent.errMu.Lock()
+	defer agent.errMu.Unlock()
+	return agent.lastErr, agent.lastErrTime
+}
+
 // MessageAgent implements MessageDelegate
 func (agent *MessageAgent) MessageAgent() *MessageAgent {
 	return agent
 }
 
 func (agent *MessageAgent) Subscribe(kind string, do MessageHandler) {
+	if err := agent.subscribe(kind, getMessageHandlerKey(do), do); err != nil {
+		warn(err)
+	}
+}
+
+// SubscribeMany subscribes each handler to its kind.  Kinds that could not be subscribed are
+// reported together in the returned SubscribeErrors.
+func (agent *MessageAgent) SubscribeMany(handlers map[string]MessageHandler) error {
+	errs := make(SubscribeErrors)
+	for kind, do := range handlers {
+		if err := agent.subscribe(kind, getMessageHandlerKey(do), do); err != nil {
+			errs[kind] = err
+		}
+	}
+
+	return errs.orNil()
+}
+
+// SubscribeDecoded subscribes a handler that receives the message's data decoded from JSON into a
+// new value of the same type as prototype.  If prototype is a pointer, do receives a pointer to a
+// new value, otherwise it receives the value itself.  Messages that cannot be decoded are thrown
+// and skip the handler.  A nil prototype is reported as ErrNilPrototype.
+func (agent *MessageAgent) SubscribeDecoded(kind string, prototype interface{}, do func(interface{}, *Message)) {
+	if prototype == nil {
+		warn(ErrNilPrototype)
+		return
+	}
+	t := reflect.TypeOf(prototype)
+	isPtr := t.Kind() == reflect.Ptr
+	if isPtr {
+		t = t.Elem()
+	}
+	decoded := func(m *Message) {
+		var envelope struct {
+			Data json.RawMessage `json:"data"`
+		}
+		v := reflect.New(t)
+		if err := json.Unmarshal(m.Raw, &envelope); err != nil {
+			agent.throw(err)
+			return
+		}
+		if len(envelope.Data) > 0 {
+			if err := json.Unmarshal(envelope.Data, v.Interface()); err != nil {
+				agent.throw(err)
+				return
+			}
+		}
+		if isPtr {
+			do(v.Interface(), m)
+		} else {
+			do(v.Elem().Interface(), m)
+		}
+	}
+	if err := agent.subscribe(kind, getDecodedHandlerKey(do), decoded); err != nil {
+		warn(err)
+	}
+}
+
+// UnsubscribeDecoded removes a handler subscribed with SubscribeDecoded.
+func (agent *MessageAgent) UnsubscribeDecoded(kind string, do func(interface{}, *Message)) {
+	agent.UnsubscribeKeyed(kind, getDecodedHandlerKey(do))
+}
+
+// decodedHandler is a handler subscribed with SubscribeDecoded.
+type decodedHandler func(interface{}, *Message)
+
+func getDecodedHandlerKey(do decodedHandler) string {
+	return fmt.Sprintf("%v", do)
+}
+
+// SubscribeErr subscribes a handler that can fail.  An error returned by do is thrown, and if
+// the message has an ID, an ErrorEnvelope with HandlerErrorCode and the error's text is sent to
+// the client in reply.
+func (agent *MessageAgent) SubscribeErr(kind string, do func(*Message) error) {
+	handler := func(m *Message) {
+		err := do(m)
+		if err == nil {
+			return
+		}
+		agent.throw(err)
+		if m.ID != "" {
+			if err := agent.SendError(HandlerErrorCode, err.Error(), m); err != nil {
+				agent.throw(err)
+			}
+		}
+	}
+	if err := agent.subscribe(kind, getErrHandlerKey(do), handler); err != nil {
+		warn(err)
+	}
+}
+
+// UnsubscribeErr removes a handler subscribed with SubscribeErr.
+func (agent *MessageAgent) UnsubscribeErr(kind string, do func(*Message) error) {
+	agent.UnsubscribeKeyed(kind, getErrHandlerKey(do))
+}
+
+// errHandler is a handler subscribed with SubscribeErr.
+type errHandler func(*Message) error
+
+func getErrHandlerKey(do errHandler) string {
+	return fmt.Sprintf("%v", do)
+}
+
+func (agent *MessageAgent) subscribe(kind, key string, do MessageHandler) error {
+	agent.subscriptionsMu.Lock()
+	defer agent.subscriptionsMu.Unlock()
 	if _, ok := agent.subscriptions[kind]; !ok {
 		agent.subscriptions[kind] = make(MessageHandlerSet)
 	}
-	agent.subscriptions[kind].Add(do)
+	return agent.subscriptions[kind].add(key, do)
+}
+
+// handlers returns a snapshot of the handlers for kind, and whether the agent has subscribed to
+// kind.
+func (agent *MessageAgent) handlers(kind string) ([]MessageHandler, bool) {
+	agent.subscriptionsMu.RLock()
+	defer agent.subscriptionsMu.RUnlock()
+	set, ok := agent.subscriptions[kind]
+	handlers := make([]MessageHandler, 0, len(set))
+	for _, do := range set {
+		handlers = append(handlers, do)
+	}
+	return handlers, ok
+}
+
+// kinds returns the kinds that the agent subscribes to.
+func (agent *MessageAgent) kinds() []string {
+	agent.subscriptionsMu.RLock()
+	defer agent.subscriptionsMu.RUnlock()
+	kinds := make([]string, 0, len(agent.subscriptions))
+	for kind := range agent.subscriptions {
+		kinds = append(kinds, kind)
+	}
+	return kinds
 }
 
+// Unsubscribe removes a handler for kind.  If it is called while the agent is running handlers
+// for kind, e.g. by a handler unsubscribing itself, the removal takes effect once they have all
+// run.  Handlers for other kinds don't delay it.
 func (agent *MessageAgent) Unsubscribe(kind string, do MessageHandler) {
+	agent.UnsubscribeKeyed(kind, getMessageHandlerKey(do))
+}
+
+// SubscribeKeyed is like Subscribe, but the handler is identified by key rather than by the
+// function, so that handlers made by the same code, such as closures, can be told apart and
+// removed reliably with UnsubscribeKeyed.  It returns ErrDuplicateHandler if key is in use.
+func (agent *MessageAgent) SubscribeKeyed(kind, key string, do MessageHandler) error {
+	return agent.subscribe(kind, key, do)
+}
+
+// UnsubscribeKeyed removes the handler for kind that was subscribed with key.  Like Unsubscribe,
+// the removal waits for any handlers for kind that are running.
+func (agent *MessageAgent) UnsubscribeKeyed(kind, key string) {
+	if agent.dispatch.deferChange(kind, func() { agent.unsubscribe(kind, key) }) {
+		return
+	}
+	agent.unsubscribe(kind, key)
+}
+
+func (agent *MessageAgent) unsubscribe(kind, key string) {
+	agent.subscriptionsMu.Lock()
+	defer agent.subscriptionsMu.Unlock()
 	if handlers, ok := agent.subscriptions[kind]; ok {
-		handlers.Remove(do)
+		delete(handlers, key)
 	} else {
 		warn(ErrNoSubscriptions)
 	}
 }
 
+// PushMessage queues a message to be sent to the client without blocking.  If the agent's send
+// buffer is full, the message is dropped and ErrSendBufferFull is reported.
 func (agent *MessageAgent) PushMessage(m []byte, mtype int) {
+	if err := agent.TryPushMessage(m, mtype); err != nil {
+		agent.throw(err)
+	}
+}
+
+// TryPushMessage is like PushMessage, but returns errors rather than reporting them.
+func (agent *MessageAgent) TryPushMessage(m []byte, mtype int) error {
+	send, err := agent.sendChannel(mtype)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&agent.pending, 1)
+	select {
+	case send <- m:
+		return nil
+	default:
+		atomic.AddInt64(&agent.pending, -1)
+		return ErrSendBufferFull
+	}
+}
+
+// PushMessageTimeout queues a message to be sent to the client, waiting up to timeout for space
+// in the send buffer.  Returns ErrSendTimeout if no space became available in time.
+func (agent *MessageAgent) PushMessageTimeout(m []byte, mtype int, timeout time.Duration) error {
+	send, err := agent.sendChannel(mtype)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&agent.pending, 1)
+	select {
+	case send <- m:
+		return nil
+	case <-time.After(timeout):
+		atomic.AddInt64(&agent.pending, -1)
+		return ErrSendTimeout
+	}
+}
+
+// PushPriority queues a message to be sent to the client ahead of any messages queued with
+// PushMessage, e.g. for control messages.  Like PushMessage, it does not block, and reports
+// ErrSendBufferFull if the priority queue is full.
+func (agent *MessageAgent) PushPriority(m []byte, mtype int) {
+	if mtype != websocket.TextMessage && mtype != websocket.BinaryMessage {
+		agent.throw(ErrBadMessageType)
+		return
+	}
+	atomic.AddInt64(&agent.pending, 1)
+	select {
+	case agent.sendPriority <- frame{mtype, m}:
+	default:
+		atomic.AddInt64(&agent.pending, -1)
+		agent.throw(ErrSendBufferFull)
+	}
+}
+
+// flushed reports whether every queued message has been written.
+func (agent *MessageAgent) flushed() bool {
+	return atomic.LoadInt64(&agent.pending) == 0
+}
+
+// waitFlushed waits until every queued message has been written, the connection is lost, or ctx
+// is done.
+func (agent *MessageAgent) waitFlushed(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for !agent.flushed() {
+		select {
+		case <-ticker.C:
+		case <-agent.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (agent *MessageAgent) sendChannel(mtype int) (chan []byte, error) {
 	switch mtype {
 	case websocket.BinaryMessage:
-		agent.sendBinary <- m
+		return agent.sendBinary, nil
 	case websocket.TextMessage:
-		agent.sendText <- m
+		return agent.sendText, nil
 	default:
-		throw(ErrBadMessageType)
+		return nil, ErrBadMessageType
+	}
+}
+
+// SendJSON encodes v with Marshaler and sends it to the client as a text message.
+func (agent *MessageAgent) SendJSON(v interface{}) error {
+	m, err := Marshaler(v)
+	if err != nil {
+		return err
+	}
+	agent.PushMessage(m, websocket.TextMessage)
+
+	return nil
+}
+
+// SendEvent forwards an event to the client as a JSON message with the event's kind and data.
+// Events may be combined into batches, see SetBroadcastBatching.
+func (agent *MessageAgent) SendEvent(e *Event) error {
+	m, err := MarshalJSONMessage(e.Kind, e.Data)
+	if err != nil {
+		return err
+	}
+	if agent.batchEvent(m) {
+		return nil
 	}
+	agent.PushMessage(m, websocket.TextMessage)
+
+	return nil
+}
+
+// SendError marshals an ErrorEnvelope and sends it to the client as a text message.
+func (agent *MessageAgent) SendError(code, message string, relatedTo *Message) error {
+	return agent.SendJSON(NewErrorEnvelope(code, message, relatedTo))
+}
+
+// SetRecipientResolver sets a function that determines the Recipient of each received message,
+// in place of the Delegate or the agent itself.  This allows several logical identities to share
+// a single connection.  Pass nil to restore the default behavior.
+func (agent *MessageAgent) SetRecipientResolver(resolve func(*Message) interface{}) {
+	agent.delegateMu.Lock()
+	defer agent.delegateMu.Unlock()
+	agent.resolveRecipient = resolve
+}
+
+// GetDelegate returns the object that receives messages in place of the agent, or nil.
+func (agent *MessageAgent) GetDelegate() interface{} {
+	agent.delegateMu.RLock()
+	defer agent.delegateMu.RUnlock()
+	return agent.Delegate
+}
+
+// SetDelegate sets an object to become the Recipient of messages received by the agent.  It is
+// safe to call at any time, and takes effect for messages received after it returns.
+func (agent *MessageAgent) SetDelegate(delegate interface{}) {
+	agent.delegateMu.Lock()
+	defer agent.delegateMu.Unlock()
+	agent.Delegate = delegate
+}
+
+// Stats returns the traffic counts for the agent's connection.
+func (agent *MessageAgent) Stats() ConnStats {
+	return ConnStats{
+		BytesRead:       atomic.LoadUint64(&agent.stats.BytesRead),
+		BytesWritten:    atomic.LoadUint64(&agent.stats.BytesWritten),
+		MessagesRead:    atomic.LoadUint64(&agent.stats.MessagesRead),
+		MessagesWritten: atomic.LoadUint64(&agent.stats.MessagesWritten),
+	}
+}
+
+// LastSeq returns the sequence number of the most recently received message, or 0 if no messages
+// have been received.
+func (agent *MessageAgent) LastSeq() uint64 {
+	return atomic.LoadUint64(&agent.seq)
 }
 
 func (agent *MessageAgent) StopListening(kind string) {
+	agent.subscriptionsMu.Lock()
+	defer agent.subscriptionsMu.Unlock()
 	delete(agent.subscriptions, kind)
 }
 
+// NegotiatedExtensions returns the WebSocket extensions that were negotiated when the agent
+// upgraded its connection, e.g. "permessage-deflate" if compression is enabled and the client
+// supports it.  It is empty for connections upgraded elsewhere and passed to Attach.
+func (agent *MessageAgent) NegotiatedExtensions() []string {
+	return append([]string(nil), agent.extensions...)
+}
+
+// negotiatedExtensions returns the extensions that the upgrader accepts from those offered in r,
+// which are only permessage-deflate, if compress is set.
+func negotiatedExtensions(r *http.Request, compress bool) []string {
+	if !compress {
+		return nil
+	}
+	for _, offers := range r.Header["Sec-Websocket-Extensions"] {
+		for _, offer := range strings.Split(offers, ",") {
+			name := strings.TrimSpace(strings.SplitN(offer, ";", 2)[0])
+			if name == "permessage-deflate" {
+				return []string{name}
+			}
+		}
+	}
+	return nil
+}
+
+// SetKindCompression sets whether outgoing messages of kind are compressed, in place of
+// EnableCompression, e.g. to skip payloads that are already compressed.  The kind of each outgoing
+// message is found with DefaultTextParser.  Compression only happens if the client negotiated it.
+func (agent *MessageAgent) SetKindCompression(kind string, compress bool) {
+	agent.compressMu.Lock()
+	defer agent.compressMu.Unlock()
+	if agent.compressKinds == nil {
+		agent.compressKinds = make(map[string]bool)
+	}
+	agent.compressKinds[kind] = compress
+}
+
+// shouldCompress reports whether message m should be compressed.
+func (agent *MessageAgent) shouldCompress(m []byte) bool {
+	agent.compressMu.RLock()
+	defer agent.compressMu.RUnlock()
+	if len(agent.compressKinds) == 0 {
+		return EnableCompression
+	}
+	pm, err := DefaultTextParser(m)
+	if err != nil {
+		return EnableCompression
+	}
+	if compress, ok := agent.compressKinds[pm.Kind]; ok {
+		return compress
+	}
+	return EnableCompression
+}
+
+// SetParserChain replaces the agent's Parser with parsers, which are tried in order until one
+// succeeds.  If all of them fail, the message is rejected with ErrUnparseableMessage.  This allows
+// clients that mix message formats to share an agent.
+func (agent *MessageAgent) SetParserChain(parsers ...MessageParser) {
+	agent.Parser = parserChain(parsers)
+}
+
 func (agent *MessageAgent) ParseText(m []byte) (*ParsedMessage, error) {
 	if agent.Parser != nil {
 		return agent.Parser.ParseText(m)
@@ -135,11 +717,63 @@ func (agent *MessageAgent) ParseBinary(m []byte) (*ParsedMessage, error) {
 	return nil, errNotYetImplemented
 }
 
-func (agent *MessageAgent) connect(w http.ResponseWriter, r *http.Request) error {
+// Connect upgrades the request and starts reading and writing messages on the connection.
+// If an error is returned, an error response has already been written to w.
+func (agent *MessageAgent) Connect(w http.ResponseWriter, r *http.Request) error {
+	if err := agent.connect(w, r, 0); err != nil {
+		return err
+	}
+	agent.register()
+
+	return nil
+}
+
+// register adds the agent to its hub's connected agents, unless it has already disconnected.
+// cleanup closes done before it removes the agent with the hub's lock held, so the agent can't be
+// left behind.
+func (agent *MessageAgent) register() {
+	agent.Hub.mu.Lock()
+	defer agent.Hub.mu.Unlock()
+	select {
+	case <-agent.done:
+		return
+	default:
+	}
+	agent.Hub.agents[agent] = struct{}{}
+}
+
+// connect upgrades the request, allowing handshakeTimeout for the handshake, or HandshakeTimeout
+// if it is 0.  If the request is cancelled before the connection is ready, the connection is
+// abandoned and the request's error returned.
+func (agent *MessageAgent) connect(w http.ResponseWriter, r *http.Request, handshakeTimeout time.Duration) error {
+	if err := r.Context().Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	if agent.Hub.isDraining() {
+		http.Error(w, ErrHubDraining.Error(), http.StatusServiceUnavailable)
+		return ErrHubDraining
+	}
+	if handshakeTimeout == 0 {
+		handshakeTimeout = HandshakeTimeout
+	}
+	if err := agent.Hub.admit(w); err != nil {
+		return err
+	}
+	release, err := agent.Hub.acquireAccept(w, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := agent.Hub.checkUpgrade(w, r); err != nil {
+		return err
+	}
 	upgrader := websocket.Upgrader{
-		HandshakeTimeout: HandshakeTimeout,
-		ReadBufferSize:   ReadBufferSize,
-		WriteBufferSize:  WriteBufferSize,
+		HandshakeTimeout:  handshakeTimeout,
+		ReadBufferSize:    ReadBufferSize,
+		WriteBufferSize:   WriteBufferSize,
+		Subprotocols:      agent.Hub.subprotocols(),
+		EnableCompression: EnableCompression,
 	}
 	// TODO add response header?
 	var responseHeader http.Header
@@ -147,34 +781,224 @@ func (agent *MessageAgent) connect(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
+	agent.extensions = negotiatedExtensions(r, upgrader.EnableCompression)
+	if pongJitter > 0 {
+		agent.pongJitter = time.Duration(rand.Int63n(int64(2*pongJitter+1))) - pongJitter
+	}
+	if p, ok := agent.Hub.protocolParser(conn.Subprotocol()); ok && agent.Parser == nil {
+		agent.Parser = p
+	}
+	if err := r.Context().Err(); err != nil {
+		conn.Close()
+		return err
+	}
+	// net/http cancels the request's context as soon as the handler returns, so the connection
+	// keeps the request's values but not its cancellation
+	agent.ctx, agent.cancel = context.WithCancel(valuesContext{r.Context()})
+	agent.attachMu.Lock()
+	defer agent.attachMu.Unlock()
+	agent.attach(conn)
+
+	return nil
+}
+
+// valuesContext carries the values of its parent, but never has a deadline or is cancelled.
+type valuesContext struct {
+	parent context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valuesContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valuesContext) Err() error {
+	return nil
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// Attach starts reading and writing messages on conn, which has already been upgraded.  The agent
+// keeps its subscriptions, delegate and queued messages.  It returns ErrAlreadyAttached if the
+// agent already has a connection, or ErrMessageConnectionLost if the agent has disconnected.
+func (agent *MessageAgent) Attach(conn Conn) error {
+	agent.attachMu.Lock()
+	defer agent.attachMu.Unlock()
+	if agent.conn != nil {
+		return ErrAlreadyAttached
+	}
+	select {
+	case <-agent.done:
+		return ErrMessageConnectionLost
+	default:
+	}
+	agent.attach(conn)
+	agent.register()
+
+	return nil
+}
+
+// Detach stops reading and writing messages on the agent's connection without closing it, and
+// returns it.  The agent keeps its subscriptions, and messages pushed while it is detached are
+// sent once a connection is attached.  Detach must not be called from a message handler.
+//
+// A read that is interrupted by Detach leaves the connection unable to read, so the connection
+// that is returned can only be written to or closed.
+func (agent *MessageAgent) Detach() (Conn, error) {
+	agent.attachMu.Lock()
+	defer agent.attachMu.Unlock()
+	if agent.conn == nil {
+		return nil, ErrNotAttached
+	}
+	if agent.isClosing() {
+		return nil, ErrMessageConnectionLost
+	}
+	atomic.StoreInt32(&agent.detaching, 1)
+	close(agent.stop)
+	agent.conn.SetReadDeadline(time.Now())
+	agent.loops.Wait()
+	atomic.StoreInt32(&agent.detaching, 0)
+
+	agent.connMu.Lock()
+	defer agent.connMu.Unlock()
+	select {
+	case <-agent.done:
+		// the connection was lost before the loops stopped
+		return nil, ErrMessageConnectionLost
+	default:
+	}
+	if agent.isClosing() {
+		// disconnect has sent a close frame, so the connection is on its way out
+		return nil, ErrMessageConnectionLost
+	}
+	conn := agent.conn
+	agent.conn = nil
+
+	return conn, nil
+}
+
+// attach must be called with attachMu held.
+func (agent *MessageAgent) attach(conn Conn) {
+	agent.connMu.Lock()
 	agent.conn = conn
+	agent.connMu.Unlock()
+	if agent.ctx == nil {
+		agent.ctx, agent.cancel = context.WithCancel(context.Background())
+	}
+	agent.stop = make(chan struct{})
+	agent.loops.Add(2)
 	go agent.startReading()
 	go agent.startWriting()
+}
+
+// stopped runs when either loop exits.  Unless the connection is being detached, the agent has
+// disconnected.
+func (agent *MessageAgent) stopped() {
+	if atomic.LoadInt32(&agent.detaching) == 1 {
+		return
+	}
+	agent.cleanup()
+}
+
+// Close disconnects the client with a normal closure, see disconnect.  It returns the error from
+// sending the close frame, if any, in which case the connection is closed immediately.  Calling
+// Close on an agent that is already closing does nothing.
+func (agent *MessageAgent) Close() error {
+	return agent.disconnect(websocket.CloseNormalClosure)
+}
 
+// disconnect sends a close frame with the given code to the client.  The connection is closed,
+// stopping the read and write loops, when the client acknowledges the close frame or after
+// CloseGracePeriod, whichever comes first.
+func (agent *MessageAgent) disconnect(code int) error {
+	if !atomic.CompareAndSwapInt32(&agent.closing, 0, 1) {
+		return nil
+	}
+	agent.recordDisconnect(&websocket.CloseError{Code: code})
+	// the close frame is sent with connMu held, so that Detach can't hand the connection over
+	// while it is being closed
+	agent.connMu.Lock()
+	conn := agent.conn
+	var err error
+	if conn != nil {
+		closeMessage := websocket.FormatCloseMessage(code, "")
+		err = conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(Timeout))
+	}
+	agent.connMu.Unlock()
+	if conn == nil || err != nil {
+		agent.cleanup()
+		return err
+	}
+	time.AfterFunc(CloseGracePeriod, agent.cleanup)
 	return nil
 }
 
+func (agent *MessageAgent) isClosing() bool {
+	return atomic.LoadInt32(&agent.closing) == 1
+}
+
 func (agent *MessageAgent) startReading() {
-	defer agent.cleanup()
+	defer agent.loops.Done()
+	defer agent.stopped()
+	agent.armPendingAuth()
 
 	agent.conn.SetReadLimit(ReadLimit)
-	agent.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	agent.conn.SetReadDeadline(time.Now().Add(agent.pongTimeout()))
 	agent.conn.SetPongHandler(agent.handlePong)
 	agent.conn.SetCloseHandler(agent.handleClose)
 
 	for {
 		mtype, m, err := agent.conn.ReadMessage()
 		if err != nil {
-			// TODO this doesn't really throw, or raise - it just reports; rename
-			throw(err)
-			agent.cleanup()
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				atomic.StoreInt32(&agent.missedPong, 1)
+				err = ErrMissedPong
+			}
+			if atomic.LoadInt32(&agent.detaching) == 1 {
+				// the read was interrupted by Detach
+				return
+			}
+			agent.recordDisconnect(err)
+			if agent.isClosing() {
+				// the close handshake has completed
+				return
+			}
+			select {
+			case <-agent.done:
+				// the connection was closed on this side, which is not an error
+			default:
+				// TODO this doesn't really throw, or raise - it just reports; rename
+				agent.throw(err)
+			}
 			return
 		}
+		if agent.isClosing() {
+			// waiting for the client to acknowledge the close frame
+			continue
+		}
+		size := int64(len(m))
+		if !agent.Hub.reserveInflight(size) {
+			agent.throw(ErrMemoryPressure)
+			agent.disconnect(websocket.CloseTryAgainLater)
+			continue
+		}
 		agent.acceptMessage(mtype, m)
+		agent.Hub.releaseInflight(size)
 	}
 }
 
 func (agent *MessageAgent) acceptMessage(mtype int, m []byte) {
+	agent.touch()
+	atomic.AddUint64(&agent.stats.BytesRead, uint64(len(m)))
+	atomic.AddUint64(&agent.stats.MessagesRead, 1)
+	if agent.authenticate(m) {
+		return
+	}
 	var (
 		p   *ParsedMessage
 		err error
@@ -183,37 +1007,63 @@ func (agent *MessageAgent) acceptMessage(mtype int, m []byte) {
 	case websocket.BinaryMessage:
 		p, err = agent.ParseBinary(m)
 		if err != nil {
-			throw(err)
+			agent.throw(err)
 			return
 		}
 	case websocket.TextMessage:
 		p, err = agent.ParseText(m)
 		if err != nil {
-			throw(err)
+			agent.throw(err)
 			return
 		}
 	default:
-		throw(ErrUnparseableMessage)
+		agent.throw(ErrUnparseableMessage)
+		return
+	}
+	if agent.duplicate(p) {
 		return
 	}
 	message := &Message{}
 	message.Data = p.Value
 	message.Kind = p.Kind
+	message.ID = p.ID
+	message.Seq = atomic.AddUint64(&agent.seq, 1)
 	message.Raw = p.Raw
 	message.Source = agent
-	if agent.Delegate != nil {
-		message.Recipient = agent.Delegate
+	agent.delegateMu.RLock()
+	resolve, delegate := agent.resolveRecipient, agent.Delegate
+	agent.delegateMu.RUnlock()
+	if resolve != nil {
+		message.Recipient = resolve(message)
+	} else if delegate != nil {
+		message.Recipient = delegate
 	} else {
 		message.Recipient = agent
 	}
+	message.ctx = agent.ctx
+	if deadline, ok := DeadlineExtractor(message); ok {
+		var cancel context.CancelFunc
+		// the deadline is measured by the package clock, which need not match the real time
+		message.ctx, cancel = context.WithTimeout(message.Context(), deadline.Sub(now()))
+		defer cancel()
+	}
 
 	agent.handle(message)
 }
 
 func (agent *MessageAgent) handle(m *Message) {
-	if handlers, ok := agent.subscriptions[m.Kind]; ok {
+	if handlers, ok := agent.handlers(m.Kind); ok {
+		if !agent.Hub.allowDispatch(m.Kind) {
+			return
+		}
+		agent.dispatch.begin(m.Kind)
+		defer agent.dispatch.end(m.Kind)
 		for _, h := range handlers {
-			h(m)
+			agent.Hub.runHandler(m.Kind, m.Recipient, m.Context(), func(ctx context.Context) {
+				view := *m
+				view.ctx = ctx
+				h(&view)
+			})
 		}
 		return
 	}
@@ -222,60 +1072,166 @@ func (agent *MessageAgent) handle(m *Message) {
 }
 
 func (agent *MessageAgent) startWriting() {
-	ticker := time.NewTicker(pingPeriod)
+	nextPing := after(pingPeriod)
+	stop := agent.stop
 	defer func() {
-		warn(ErrMessageConnectionLost)
-		ticker.Stop()
-		agent.cleanup()
+		if atomic.LoadInt32(&agent.detaching) == 0 {
+			warn(ErrMessageConnectionLost)
+		}
+		agent.stopped()
+		agent.loops.Done()
 	}()
 
 	for {
+		if err := agent.writePriority(); err != nil {
+			agent.recordDisconnect(err)
+			return
+		}
+		var err error
 		select {
-		case message, ok := <-agent.sendText:
-			if !ok {
-				return
-			}
-			agent.doWrite(websocket.BinaryMessage, message)
-		case message, ok := <-agent.sendBinary:
-			if !ok {
-				return
-			}
-			agent.doWrite(websocket.TextMessage, message)
-		case <-ticker.C:
-			if err := agent.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(Timeout)); err != nil {
-				return
+		case <-agent.done:
+			return
+		case <-stop:
+			// the agent is being detached, and may be attached again
+			agent.flushBatch()
+			return
+		case f := <-agent.sendPriority:
+			err = agent.writeQueued(f.mtype, f.data)
+		case message := <-agent.sendText:
+			err = agent.writeCoalesced(websocket.TextMessage, message)
+		case message := <-agent.sendBinary:
+			err = agent.writeCoalesced(websocket.BinaryMessage, message)
+		case <-agent.batch.flush:
+			err = agent.flushBatch()
+		case <-nextPing:
+			err = agent.ping()
+			nextPing = after(pingPeriod)
+		}
+		if err != nil {
+			agent.recordDisconnect(err)
+			return
+		}
+	}
+}
+
+// writePriority writes up to maxPriorityBurst queued priority frames, so that a steady stream of
+// priority frames can't starve the normal send queues.
+func (agent *MessageAgent) writePriority() error {
+	for i := 0; i < maxPriorityBurst; i++ {
+		select {
+		case f := <-agent.sendPriority:
+			if err := agent.writeQueued(f.mtype, f.data); err != nil {
+				return err
 			}
+		default:
+			return nil
 		}
 	}
+	return nil
 }
 
-func (agent *MessageAgent) doWrite(mtype int, m []byte) {
+// writeQueued writes a message that was taken from a send queue.
+func (agent *MessageAgent) writeQueued(mtype int, m []byte) error {
+	defer atomic.AddInt64(&agent.pending, -1)
+	return agent.doWrite(mtype, m)
+}
+
+func (agent *MessageAgent) doWrite(mtype int, m []byte) error {
+	if agent.isClosing() {
+		// nothing may follow the close frame
+		return nil
+	}
+	agent.writeMu.Lock()
+	defer agent.writeMu.Unlock()
 	agent.conn.SetWriteDeadline(time.Now().Add(Timeout))
-	if err := agent.conn.WriteMessage(mtype, m); err != nil {
-		throw(err)
+	agent.conn.EnableWriteCompression(agent.shouldCompress(m))
+	err := agent.conn.WriteMessage(mtype, m)
+	if err != nil {
+		agent.throw(err)
+		return err
 	}
+	atomic.AddUint64(&agent.stats.BytesWritten, uint64(len(m)))
+	atomic.AddUint64(&agent.stats.MessagesWritten, 1)
+	return nil
 }
 
+// cleanup runs once when the connection is lost, for whatever reason.  Closing the connection
+// unblocks the read loop, and closing done stops the write loop, so that whichever loop exits
+// first takes the other with it.
 func (agent *MessageAgent) cleanup() {
-	if _, ok := <-agent.sendBinary; ok {
-		close(agent.sendBinary)
-	}
-	if _, ok := <-agent.sendText; ok {
-		close(agent.sendText)
+	agent.cleanupOnce.Do(func() {
+		close(agent.done)
+		if agent.cancel != nil {
+			agent.cancel()
+		}
+		agent.connMu.Lock()
+		conn := agent.conn
+		agent.connMu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		agent.Hub.agentDisconnected(agent)
+		agent.runDisconnectCallbacks()
+	})
+}
+
+// LastActive returns the time that the agent last received a message or pong, or the zero time
+// if it has received neither.
+func (agent *MessageAgent) LastActive() time.Time {
+	nanos := atomic.LoadInt64(&agent.lastActive)
+	if nanos == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, nanos)
+}
+
+func (agent *MessageAgent) touch() {
+	atomic.StoreInt64(&agent.lastActive, now().UnixNano())
+}
 
-	// TODO tj handle abnormal closure
-	agent.conn.WriteControl(websocket.CloseNormalClosure, []byte{}, time.Now().Add(Timeout))
-	agent.conn.Close()
+// MissedPong reports whether the connection was dropped because the client failed to respond
+// to a ping in time.
+func (agent *MessageAgent) MissedPong() bool {
+	return atomic.LoadInt32(&agent.missedPong) == 1
+}
+
+// pongTimeout is the time this connection allows for a pong, including its jitter.
+func (agent *MessageAgent) pongTimeout() time.Duration {
+	return pongTimeout + agent.pongJitter
+}
+
+// ping sends a ping carrying the current time, which the client echoes in its pong.
+func (agent *MessageAgent) ping() error {
+	sent := now().UnixNano()
+	atomic.StoreInt64(&agent.lastPing, sent)
+	payload := []byte(strconv.FormatInt(sent, 10))
+	return agent.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(Timeout))
 }
 
 func (agent *MessageAgent) handlePong(pong string) error {
-	agent.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	agent.touch()
+	agent.conn.SetReadDeadline(time.Now().Add(agent.pongTimeout()))
+	// only a pong that echoes the latest ping is used to measure the round trip
+	sent, err := strconv.ParseInt(pong, 10, 64)
+	if err == nil && sent != 0 && atomic.CompareAndSwapInt64(&agent.lastPing, sent, 0) {
+		atomic.StoreInt64(&agent.rtt, now().UnixNano()-sent)
+	}
 	return nil
 }
 
-// TODO tj
+// RTT returns the round trip time measured by the most recent ping, or 0 if none has been
+// measured yet.
+func (agent *MessageAgent) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&agent.rtt))
+}
+
+// handleClose echoes the client's close frame, unless it acknowledges one sent by disconnect.  The
+// read loop then exits and cleans up.
 func (agent *MessageAgent) handleClose(code int, text string) error {
-	agent.cleanup()
+	if !atomic.CompareAndSwapInt32(&agent.closing, 0, 1) {
+		return nil
+	}
+	closeMessage := websocket.FormatCloseMessage(code, "")
+	agent.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(Timeout))
 	return nil
 }
@@ -0,0 +1,114 @@
+package artemis
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+)
+
+// PatchKind and StateKind are the kinds of the messages sent by SendJSONPatch.  A client keeps
+// the last state it received, and:
+//
+//	on {"kind": "state", "data": doc}, replaces its state with doc
+//	on {"kind": "patch", "data": patch}, applies patch to its state as a JSON Merge Patch (RFC 7386)
+const (
+	PatchKind = "patch"
+	StateKind = "state"
+)
+
+// SendJSONPatch sends the client the changes from prev to next as a JSON Merge Patch, so that a
+// client holding prev can compute next.  Both are encoded with Marshaler.  If the patch would be
+// larger than next itself, or can't express the change, e.g. because next contains nulls, next is
+// sent whole instead.  See PatchKind for the client's side of the contract.
+func (agent *MessageAgent) SendJSONPatch(prev, next interface{}) error {
+	prevDoc, err := toJSONValue(prev)
+	if err != nil {
+		return err
+	}
+	nextDoc, err := toJSONValue(next)
+	if err != nil {
+		return err
+	}
+	full, err := MarshalJSONMessage(StateKind, nextDoc)
+	if err != nil {
+		return err
+	}
+	if patch, ok := mergePatch(prevDoc, nextDoc); ok {
+		m, err := MarshalJSONMessage(PatchKind, patch)
+		if err != nil {
+			return err
+		}
+		if len(m) < len(full) {
+			return agent.TryPushMessage(m, websocket.TextMessage)
+		}
+	}
+
+	return agent.TryPushMessage(full, websocket.TextMessage)
+}
+
+// toJSONValue encodes v with Marshaler and decodes it into generic JSON values.
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := Marshaler(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+// mergePatch returns a merge patch that turns prev into next, or false if there is none, because
+// a merge patch can't set a value to null.
+func mergePatch(prev, next interface{}) (interface{}, bool) {
+	prevObj, prevOK := prev.(map[string]interface{})
+	nextObj, nextOK := next.(map[string]interface{})
+	if !prevOK || !nextOK {
+		// anything but an object replaces the target whole
+		return next, !containsNull(next)
+	}
+	patch := make(map[string]interface{})
+	for key := range prevObj {
+		if _, ok := nextObj[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	for key, value := range nextObj {
+		old, existed := prevObj[key]
+		if existed && reflect.DeepEqual(old, value) {
+			continue
+		}
+		if value == nil {
+			return nil, false
+		}
+		if !existed {
+			old = nil
+		}
+		sub, ok := mergePatch(old, value)
+		if !ok {
+			return nil, false
+		}
+		patch[key] = sub
+	}
+	return patch, true
+}
+
+func containsNull(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		for _, value := range v {
+			if containsNull(value) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if containsNull(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
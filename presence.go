@@ -0,0 +1,108 @@
+package artemis
+
+import (
+	"sync"
+	"time"
+)
+
+// presence batches changes to the hub's connected clients, so that OnPresenceChange callbacks
+// fire at most once per debounce period.
+type presence struct {
+	mu       sync.Mutex
+	onChange func(joined, left []*Client)
+	joined   []*Client
+	left     []*Client
+	timer    *time.Timer
+}
+
+func (p *presence) join(c *Client, debounce time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.joined = append(p.joined, c)
+	p.schedule(debounce)
+}
+
+func (p *presence) leave(c *Client, debounce time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// a client that joins and leaves within one period is not reported at all
+	for i, joined := range p.joined {
+		if joined == c {
+			p.joined = append(p.joined[:i], p.joined[i+1:]...)
+			return
+		}
+	}
+	p.left = append(p.left, c)
+	p.schedule(debounce)
+}
+
+// schedule must be called with p.mu held.
+func (p *presence) schedule(debounce time.Duration) {
+	if p.onChange == nil || p.timer != nil {
+		return
+	}
+	p.timer = time.AfterFunc(debounce, p.flush)
+}
+
+func (p *presence) flush() {
+	p.mu.Lock()
+	joined, left, onChange := p.joined, p.left, p.onChange
+	p.joined, p.left, p.timer = nil, nil, nil
+	p.mu.Unlock()
+	if onChange != nil && (len(joined) > 0 || len(left) > 0) {
+		onChange(joined, left)
+	}
+}
+
+// OnPresenceChange sets a callback that is run when clients connect to or disconnect from the
+// hub.  Changes are batched for PresenceDebounce before the callback runs.
+func (h *Hub) OnPresenceChange(do func(joined, left []*Client)) {
+	h.presence.mu.Lock()
+	defer h.presence.mu.Unlock()
+	h.presence.onChange = do
+	h.presence.joined, h.presence.left = nil, nil
+}
+
+// PresentClients returns the clients that are currently connected to the hub.
+func (h *Hub) PresentClients() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+// registerClient adds a newly connected client to the hub, unless it has already disconnected.
+func (h *Hub) registerClient(c *Client) {
+	h.mu.Lock()
+	select {
+	case <-c.Messages.done:
+		h.mu.Unlock()
+		return
+	default:
+	}
+	h.clients[c.Messages] = c
+	debounce, kind := h.PresenceDebounce, h.ConnectedKind
+	addToDirectory(c, h)
+	h.mu.Unlock()
+	h.presence.join(c, debounce)
+	h.broadcastLifecycle(kind, c)
+}
+
+// agentDisconnected removes an agent, and its client if it has one, from the hub.
+func (h *Hub) agentDisconnected(agent *MessageAgent) {
+	h.mu.Lock()
+	delete(h.agents, agent)
+	c, ok := h.clients[agent]
+	delete(h.clients, agent)
+	debounce, kind := h.PresenceDebounce, h.DisconnectedKind
+	h.mu.Unlock()
+	if ok {
+		removeFromDirectory(c)
+		h.presence.leave(c, debounce)
+		h.broadcastLifecycle(kind, c)
+	}
+}
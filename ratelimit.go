@@ -0,0 +1,44 @@
+package artemis
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple rate limiter that allows bursts of up to burst operations, refilled at
+// rate operations per second.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := &tokenBucket{}
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = b.burst
+	b.last = time.Now()
+
+	return b
+}
+
+// allow takes a token from the bucket if one is available.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,62 @@
+package artemis
+
+import (
+	"fmt"
+	"time"
+)
+
+// redelivery holds a hub's settings for redelivering nacked events.
+type redelivery struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+// SetRedelivery makes the hub redeliver events that a handler nacks to the same subscriber, up to
+// maxRetries times.  The first redelivery waits for backoff, and each after that waits twice as
+// long as the last.  Events that are still nacked after maxRetries are sent to DeadLetters.  A
+// maxRetries of 0 or less stops redelivery, and nacked events are dropped.
+//
+// Redeliveries are not waited for by BroadcastAck.
+func (h *Hub) SetRedelivery(maxRetries int, backoff time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if maxRetries <= 0 {
+		h.redelivery = nil
+		return
+	}
+	h.redelivery = &redelivery{maxRetries, backoff}
+}
+
+// DeadLetters receives events that were still nacked after the hub's last redelivery.  If it is
+// full, dead letters are dropped with a warning.
+func (h *Hub) DeadLetters() <-chan *Event {
+	return h.deadLetters
+}
+
+// redeliver schedules a nacked event to be sent to sub again, or sends it to DeadLetters once it
+// has been retried as many times as the hub allows.
+func (h *Hub) redeliver(sub chan *Event, ev *Event) {
+	h.mu.RLock()
+	rd := h.redelivery
+	h.mu.RUnlock()
+	if rd == nil {
+		return
+	}
+	retry := *ev
+	retry.acks = nil
+	retry.Recipient = nil
+	retry.Ack()
+	if ev.Attempt > rd.maxRetries {
+		select {
+		case h.deadLetters <- &retry:
+		default:
+			warn(fmt.Errorf("Dead letters are full, dropping event '%s' (%d).", ev.Kind, ev.HubSeq))
+		}
+		return
+	}
+	retry.Attempt++
+	delay := rd.backoff << uint(ev.Attempt-1)
+	time.AfterFunc(delay, func() {
+		h.send(sub, &retry)
+	})
+}
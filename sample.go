@@ -0,0 +1,68 @@
+package artemis
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// subscriberFilter selects the subscribers that a broadcast is sent to.
+type subscriberFilter func([]chan *Event) []chan *Event
+
+// excluding returns a filter that selects every subscriber but skip.
+func excluding(skip chan *Event) subscriberFilter {
+	return func(subscribers []chan *Event) []chan *Event {
+		selected := subscribers[:0]
+		for _, sub := range subscribers {
+			if sub != skip {
+				selected = append(selected, sub)
+			}
+		}
+		return selected
+	}
+}
+
+// sampler chooses the subscribers that receive sampled broadcasts.
+type sampler struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// SetSamplingSeed makes BroadcastSampled choose subscribers with a random source seeded with
+// seed, so that the same broadcasts to the same subscribers are sampled the same way.  This is
+// intended for tests.
+func (h *Hub) SetSamplingSeed(seed int64) {
+	h.sampler.mu.Lock()
+	defer h.sampler.mu.Unlock()
+	h.sampler.rng = rand.New(rand.NewSource(seed))
+}
+
+// filter returns a filter that selects each subscriber with probability fraction.
+func (s *sampler) filter(fraction float64) subscriberFilter {
+	return func(subscribers []chan *Event) []chan *Event {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.rng != nil {
+			// subscribers come in map order, which must not affect a seeded sample
+			sort.Slice(subscribers, func(i, j int) bool {
+				return reflect.ValueOf(subscribers[i]).Pointer() < reflect.ValueOf(subscribers[j]).Pointer()
+			})
+		}
+		selected := subscribers[:0]
+		for _, sub := range subscribers {
+			if s.float64() < fraction {
+				selected = append(selected, sub)
+			}
+		}
+		return selected
+	}
+}
+
+// float64 must be called with s.mu held.
+func (s *sampler) float64() float64 {
+	if s.rng != nil {
+		return s.rng.Float64()
+	}
+	return rand.Float64()
+}
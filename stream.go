@@ -0,0 +1,63 @@
+package artemis
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamWriter writes a single message to the client in chunks.  It holds the agent's write lock
+// until it is closed.
+type streamWriter struct {
+	agent   *MessageAgent
+	w       io.WriteCloser
+	written uint64
+	once    sync.Once
+}
+
+// SendStream returns a writer for a single message of type mtype, which is sent to the client in
+// chunks as it is written rather than buffered whole.  Closing the writer ends the message.  No
+// other messages are written to the client until the writer is closed, so it must always be
+// closed.
+func (agent *MessageAgent) SendStream(mtype int) (io.WriteCloser, error) {
+	if mtype != websocket.TextMessage && mtype != websocket.BinaryMessage {
+		return nil, ErrBadMessageType
+	}
+	agent.writeMu.Lock()
+	if agent.isClosing() {
+		agent.writeMu.Unlock()
+		return nil, ErrMessageConnectionLost
+	}
+	agent.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	agent.conn.EnableWriteCompression(EnableCompression)
+	w, err := agent.conn.NextWriter(mtype)
+	if err != nil {
+		agent.writeMu.Unlock()
+		return nil, err
+	}
+
+	return &streamWriter{agent: agent, w: w}, nil
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.agent.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	n, err := sw.w.Write(p)
+	sw.written += uint64(n)
+	return n, err
+}
+
+func (sw *streamWriter) Close() error {
+	err := io.ErrClosedPipe
+	sw.once.Do(func() {
+		err = sw.w.Close()
+		if err == nil {
+			atomic.AddUint64(&sw.agent.stats.BytesWritten, sw.written)
+			atomic.AddUint64(&sw.agent.stats.MessagesWritten, 1)
+		}
+		sw.agent.writeMu.Unlock()
+	})
+	return err
+}
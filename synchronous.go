@@ -0,0 +1,38 @@
+package artemis
+
+import "sync"
+
+// synchronousDelivery runs the hub's synchronous broadcasts one at a time, in the order they were
+// made.  Broadcasts made while one is running are queued rather than waited for, so that a handler
+// may broadcast without deadlocking on the delivery that is running it.
+type synchronousDelivery struct {
+	mu      sync.Mutex
+	running bool
+	queue   []func()
+}
+
+// run delivers immediately if nothing else is being delivered, then delivers everything that was
+// queued in the meantime.  Otherwise it queues deliver for the goroutine that is delivering.
+func (sd *synchronousDelivery) run(deliver func()) {
+	sd.mu.Lock()
+	if sd.running {
+		sd.queue = append(sd.queue, deliver)
+		sd.mu.Unlock()
+		return
+	}
+	sd.running = true
+	sd.mu.Unlock()
+
+	for deliver != nil {
+		deliver()
+		sd.mu.Lock()
+		deliver = nil
+		if len(sd.queue) > 0 {
+			deliver = sd.queue[0]
+			sd.queue = sd.queue[1:]
+		} else {
+			sd.running = false
+		}
+		sd.mu.Unlock()
+	}
+}
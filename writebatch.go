@@ -0,0 +1,85 @@
+package artemis
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
+
+// CoalesceDelimiter separates the messages that are combined into a single frame by
+// MessageAgent.SetWriteCoalesce.  Clients of agents that coalesce writes must split each frame on
+// it, so it should be something that never appears inside a message, such as the newline between
+// compact JSON documents.
+var CoalesceDelimiter = []byte("\n")
+
+// writeBatch holds the messages that are waiting to be written together in one frame.
+type writeBatch struct {
+	mtype  int
+	frames [][]byte
+	size   int
+	// flush fires when the coalesce window of the first message has passed
+	flush <-chan time.Time
+}
+
+// SetWriteCoalesce makes the agent hold small outgoing messages for up to window, and combine the
+// messages of the same type that are queued in that time into a single frame, separated by
+// CoalesceDelimiter.  This saves the overhead of many tiny frames at the cost of up to window of
+// latency.  A combined frame is never larger than maxBytes, and messages of at least maxBytes are
+// written on their own; maxBytes of 0 means no limit.  Priority messages are never coalesced.  A
+// window of 0, the default, disables coalescing.
+func (agent *MessageAgent) SetWriteCoalesce(window time.Duration, maxBytes int) {
+	agent.coalesceMu.Lock()
+	defer agent.coalesceMu.Unlock()
+	agent.coalesceWindow = window
+	agent.coalesceMaxBytes = maxBytes
+}
+
+func (agent *MessageAgent) writeCoalesce() (time.Duration, int) {
+	agent.coalesceMu.Lock()
+	defer agent.coalesceMu.Unlock()
+	return agent.coalesceWindow, agent.coalesceMaxBytes
+}
+
+// writeCoalesced writes a message that was taken from a send queue, or adds it to the batch to be
+// written with the messages that follow it within the coalesce window.
+func (agent *MessageAgent) writeCoalesced(mtype int, m []byte) error {
+	window, maxBytes := agent.writeCoalesce()
+	limited := maxBytes > 0
+	b := &agent.batch
+	if len(b.frames) > 0 {
+		tooBig := limited && b.size+len(CoalesceDelimiter)+len(m) > maxBytes
+		if window <= 0 || b.mtype != mtype || tooBig {
+			if err := agent.flushBatch(); err != nil {
+				return err
+			}
+		}
+	}
+	if window <= 0 || (limited && len(m) >= maxBytes) {
+		return agent.writeQueued(mtype, m)
+	}
+	if len(b.frames) == 0 {
+		b.mtype = mtype
+		b.flush = after(window)
+	} else {
+		b.size += len(CoalesceDelimiter)
+	}
+	b.frames = append(b.frames, m)
+	b.size += len(m)
+	return nil
+}
+
+// flushBatch writes the batched messages, if any, as a single frame.
+func (agent *MessageAgent) flushBatch() error {
+	b := agent.batch
+	if len(b.frames) == 0 {
+		return nil
+	}
+	agent.batch = writeBatch{}
+	m := b.frames[0]
+	if len(b.frames) > 1 {
+		m = bytes.Join(b.frames, CoalesceDelimiter)
+	}
+	err := agent.doWrite(b.mtype, m)
+	atomic.AddInt64(&agent.pending, -int64(len(b.frames)))
+	return err
+}